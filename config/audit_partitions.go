@@ -0,0 +1,144 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	AuditPartitionPrefix = "audit_logs_p" // followed by the month, e.g. audit_logs_p202610
+	auditDefaultGroup    = "default"      // partition of entity types without their own retention
+	auditPartitionsAhead = 2              // months after the current one that get partitions in advance
+)
+
+// Entity types with their own retention become partition names, which
+// Postgres limits to 63 bytes
+var auditRetentionType = regexp.MustCompile(`^[a-z][a-z0-9_]{0,39}$`)
+
+// How long audit entries stay in the database before they are archived,
+// per entity type. Types without an entry use Default; zero keeps entries
+// forever.
+type AuditRetention struct {
+	ByType  map[string]time.Duration
+	Default time.Duration
+}
+
+// Parse a retention policy such as "api_request=90d,default=2555d".
+// Durations are whole days with a "d" suffix or Go durations.
+func ParseAuditRetention(s string) (AuditRetention, error) {
+	retention := AuditRetention{ByType: make(map[string]time.Duration)}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		entityType, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return AuditRetention{}, fmt.Errorf("invalid audit retention %q, want entity_type=duration", item)
+		}
+		entityType = strings.TrimSpace(entityType)
+		d, err := parseRetentionDuration(strings.TrimSpace(value))
+		if err != nil || d < 0 {
+			return AuditRetention{}, fmt.Errorf("invalid audit retention %q for %s", value, entityType)
+		}
+
+		if entityType == auditDefaultGroup {
+			retention.Default = d
+			continue
+		}
+		if !auditRetentionType.MatchString(entityType) {
+			return AuditRetention{}, fmt.Errorf("invalid entity type %q in audit retention", entityType)
+		}
+		retention.ByType[entityType] = d
+	}
+	return retention, nil
+}
+
+func parseRetentionDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// Retention of a partition group: an entity type, or "default" for the
+// types sharing the default partition. Types dropped from the policy fall
+// back to Default.
+func (r AuditRetention) For(group string) time.Duration {
+	if d, ok := r.ByType[group]; ok {
+		return d
+	}
+	return r.Default
+}
+
+// Create the monthly partitions of audit_logs from the month of since to
+// auditPartitionsAhead months after now. Months that already exist are left
+// alone, so a type added to the policy gets its own partitions from the
+// next new month on.
+func EnsureAuditPartitions(db *gorm.DB, retention AuditRetention, since, now time.Time) error {
+	last := AuditMonth(now).AddDate(0, auditPartitionsAhead, 0)
+	for month := AuditMonth(since); !month.After(last); month = month.AddDate(0, 1, 0) {
+		var exists bool
+		if err := db.Raw("SELECT to_regclass(?) IS NOT NULL", AuditPartitionPrefix+month.Format("200601")).Scan(&exists).Error; err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if err := EnsureAuditMonth(db, retention, month); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Create the partition of the month t falls in, split by entity type: one
+// partition per type with its own retention and a default one for the
+// rest. Parts that exist are kept, so this also restores a month that was
+// partly or fully archived before entries dated in it are written.
+func EnsureAuditMonth(db *gorm.DB, retention AuditRetention, t time.Time) error {
+	month := AuditMonth(t)
+	name := AuditPartitionPrefix + month.Format("200601")
+
+	groups := make([]string, 0, len(retention.ByType))
+	for entityType := range retention.ByType {
+		groups = append(groups, entityType)
+	}
+	sort.Strings(groups)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %q PARTITION OF audit_logs FOR VALUES FROM ('%s') TO ('%s') PARTITION BY LIST (entity_type)`,
+			name, month.Format(time.RFC3339), month.AddDate(0, 1, 0).Format(time.RFC3339))).Error
+		if err != nil {
+			return err
+		}
+		for _, entityType := range groups {
+			err := tx.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %q PARTITION OF %q FOR VALUES IN ('%s')`,
+				name+"_"+entityType, name, entityType)).Error
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %q PARTITION OF %q DEFAULT`, name+"_"+auditDefaultGroup, name)).Error
+	})
+	if err != nil {
+		return fmt.Errorf("create audit partition %s: %w", name, err)
+	}
+	return nil
+}
+
+// Start of the month t falls in, in UTC, which partition bounds use
+func AuditMonth(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
@@ -3,18 +3,62 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	DBHost     string
-	DBUser     string
-	DBPassword string
-	DBName     string
-	DBPort     string
-	JWTSecret  string
-	ServerPort string
+	DBHost            string
+	DBUser            string
+	DBPassword        string
+	DBName            string
+	DBPort            string
+	JWTSigningKeys    string        // "kid=key.pem[@RFC3339 activation]", comma separated
+	JWTKeyOverlap     time.Duration // how long a replaced key still verifies tokens
+	RefreshTokenTTL   time.Duration
+	LoginMaxFailures  int // failures per account before lockout
+	LoginMaxPerIP     int // failures per client IP before lockout
+	LoginLockout      time.Duration
+	LoginBaseDelay    time.Duration // doubled after each consecutive failure
+	LoginMaxDelay     time.Duration
+	PasswordMinLength int
+	PasswordClasses   int    // of lower, upper, digit and symbol
+	PasswordHistory   int    // previous passwords that may not be reused
+	BreachedFile      string // SHA-1 hashes of breached passwords, one per line
+	Argon2Memory      int    // KiB
+	Argon2Iterations  int
+	Argon2Threads     int
+	ServerPort        string
+	TrustedProxies    []string      // IPs or CIDRs whose X-Forwarded-For is believed; none by default
+	ShutdownTimeout   time.Duration // time allowed to finish requests and flush the audit log
+	AuditQueueSize    int
+	AuditBatchSize    int
+	AuditFlushEvery   time.Duration
+	AuditOverflow     string // "block", "drop" or "spill" when the queue is full
+	AuditSpillFile    string
+	AuditRetention    string // "entity_type=duration" per type, comma separated; "default" for the rest
+	AuditArchiveDir   string // expired audit partitions are written here before they are dropped
+	AuditArchiveEvery time.Duration
+	BalanceLockMode   string // "pessimistic" or "optimistic"
+	BalanceMaxRetries int    // retries on optimistic version conflicts
+	HoldTTL           time.Duration
+	HoldExpiryEvery   time.Duration
+	DefaultCurrency   string // currency of newly opened default accounts
+	FXRatesFile       string // optional JSON file with exchange rates loaded at startup
+	FXSpread          string // fraction kept on conversions, e.g. "0.005"
+	AdminEmail        string // user promoted to admin at startup
+	StepUpAmount      string // transfers worth more than this in DefaultCurrency need a 2FA code, "0" disables
+	MailDriver        string // "log" or "smtp"
+	MailDir           string // log driver: write mails here instead of logging them
+	MailFrom          string
+	SMTPHost          string
+	SMTPPort          string
+	SMTPUsername      string
+	SMTPPassword      string
+	AppBaseURL        string // prefix of links in emails
 }
 
 func LoadConfig() *Config {
@@ -28,13 +72,54 @@ func LoadConfig() *Config {
 	}
 
 	config := &Config{
-		DBHost:     getEnv("DB_HOST", "localhost"),
-		DBUser:     getEnv("DB_USER", "postgres"),
-		DBPassword: getEnv("DB_PASSWORD", "yourpassword"),
-		DBName:     getEnv("DB_NAME", "banking_db"),
-		DBPort:     getEnv("DB_PORT", "5432"),
-		JWTSecret:  getEnv("JWT_SECRET", "change-this-secret"),
-		ServerPort: getEnv("SERVER_PORT", "8080"),
+		DBHost:            getEnv("DB_HOST", "localhost"),
+		DBUser:            getEnv("DB_USER", "postgres"),
+		DBPassword:        getEnv("DB_PASSWORD", "yourpassword"),
+		DBName:            getEnv("DB_NAME", "banking_db"),
+		DBPort:            getEnv("DB_PORT", "5432"),
+		JWTSigningKeys:    getEnv("JWT_SIGNING_KEYS", ""),
+		JWTKeyOverlap:     getEnvDuration("JWT_KEY_OVERLAP", 30*24*time.Hour),
+		RefreshTokenTTL:   getEnvDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+		LoginMaxFailures:  getEnvInt("LOGIN_MAX_FAILURES", 5),
+		LoginMaxPerIP:     getEnvInt("LOGIN_MAX_IP_FAILURES", 50),
+		LoginLockout:      getEnvDuration("LOGIN_LOCKOUT", 15*time.Minute),
+		LoginBaseDelay:    getEnvDuration("LOGIN_BASE_DELAY", time.Second),
+		LoginMaxDelay:     getEnvDuration("LOGIN_MAX_DELAY", 30*time.Second),
+		PasswordMinLength: getEnvInt("PASSWORD_MIN_LENGTH", 10),
+		PasswordClasses:   getEnvInt("PASSWORD_CHAR_CLASSES", 3),
+		PasswordHistory:   getEnvInt("PASSWORD_HISTORY", 5),
+		BreachedFile:      getEnv("BREACHED_PASSWORDS_FILE", ""),
+		Argon2Memory:      getEnvInt("ARGON2_MEMORY_KIB", 64*1024),
+		Argon2Iterations:  getEnvInt("ARGON2_ITERATIONS", 3),
+		Argon2Threads:     getEnvInt("ARGON2_THREADS", 2),
+		ServerPort:        getEnv("SERVER_PORT", "8080"),
+		TrustedProxies:    getEnvList("TRUSTED_PROXIES"),
+		ShutdownTimeout:   getEnvDuration("SHUTDOWN_TIMEOUT", 15*time.Second),
+		AuditQueueSize:    getEnvInt("AUDIT_QUEUE_SIZE", 10000),
+		AuditBatchSize:    getEnvInt("AUDIT_BATCH_SIZE", 200),
+		AuditFlushEvery:   getEnvDuration("AUDIT_FLUSH_INTERVAL", time.Second),
+		AuditOverflow:     getEnv("AUDIT_OVERFLOW", "spill"),
+		AuditSpillFile:    getEnv("AUDIT_SPILL_FILE", "audit-spill.ndjson"),
+		AuditRetention:    getEnv("AUDIT_RETENTION", "api_request=90d"),
+		AuditArchiveDir:   getEnv("AUDIT_ARCHIVE_DIR", "audit-archive"),
+		AuditArchiveEvery: getEnvDuration("AUDIT_ARCHIVE_INTERVAL", 24*time.Hour),
+		BalanceLockMode:   getEnv("BALANCE_LOCK_MODE", "pessimistic"),
+		BalanceMaxRetries: getEnvInt("BALANCE_MAX_RETRIES", 5),
+		HoldTTL:           getEnvDuration("HOLD_TTL", 7*24*time.Hour),
+		HoldExpiryEvery:   getEnvDuration("HOLD_EXPIRY_INTERVAL", time.Minute),
+		DefaultCurrency:   getEnv("DEFAULT_CURRENCY", "TRY"),
+		FXRatesFile:       getEnv("FX_RATES_FILE", ""),
+		FXSpread:          getEnv("FX_SPREAD", "0.005"),
+		AdminEmail:        getEnv("ADMIN_EMAIL", ""),
+		StepUpAmount:      getEnv("TRANSFER_STEP_UP_AMOUNT", "10000.00"),
+		MailDriver:        getEnv("MAIL_DRIVER", "log"),
+		MailDir:           getEnv("MAIL_DIR", ""),
+		MailFrom:          getEnv("MAIL_FROM", "bbank <no-reply@bbank.local>"),
+		SMTPHost:          getEnv("SMTP_HOST", "localhost"),
+		SMTPPort:          getEnv("SMTP_PORT", "587"),
+		SMTPUsername:      getEnv("SMTP_USERNAME", ""),
+		SMTPPassword:      getEnv("SMTP_PASSWORD", ""),
+		AppBaseURL:        getEnv("APP_BASE_URL", "http://localhost:8080"),
 	}
 
 	return config
@@ -50,3 +135,42 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+// Helper function to get an integer env with default
+func getEnvInt(key string, defaultValue int) int {
+	value := getEnv(key, "")
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using %d", value, key, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+// Helper function to get a duration env (e.g. "15m", "168h") with default
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := getEnv(key, "")
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid duration %q for %s, using %s", value, key, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+// Helper function to get a comma separated env as a list, empty when unset
+func getEnvList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(getEnv(key, ""), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -43,15 +43,63 @@ func ConnectDatabase() {
 
 	DB = database
 
-	// Auto-migrate all models
-	err = DB.AutoMigrate(models.GetAllModels()...)
-	if err != nil {
+	if err := Migrate(DB, cfg); err != nil {
 		log.Fatal("Failed to migrate database:", err)
 	}
 
 	fmt.Println("PostgreSQL database connected and migrated successfully!")
 }
 
+// Bring the schema up to date: convert data from earlier versions, partition
+// the audit log and auto-migrate all models
+func Migrate(db *gorm.DB, cfg *Config) error {
+	// Convert legacy float amounts before the schema is migrated
+	if err := migrateMoneyColumns(db); err != nil {
+		return fmt.Errorf("migrate money columns: %w", err)
+	}
+
+	// One balance per user becomes one default account per user
+	if err := migrateBalancesToAccounts(db, cfg.DefaultCurrency); err != nil {
+		return fmt.Errorf("migrate balances to accounts: %w", err)
+	}
+
+	// Existing users count as verified
+	if err := addEmailVerifiedAt(db); err != nil {
+		return fmt.Errorf("add email verification column: %w", err)
+	}
+
+	// Partition the audit log before AutoMigrate sees it
+	auditRetention, err := ParseAuditRetention(cfg.AuditRetention)
+	if err != nil {
+		return err
+	}
+	if err := partitionAuditLogs(db, auditRetention); err != nil {
+		return fmt.Errorf("partition audit log: %w", err)
+	}
+	if err := dropUniqueAuditArchivePartition(db); err != nil {
+		return fmt.Errorf("migrate audit archive index: %w", err)
+	}
+
+	// Auto-migrate all models
+	if err := db.AutoMigrate(models.GetAllModels()...); err != nil {
+		return err
+	}
+
+	if err := backfillAccountIDs(db); err != nil {
+		return fmt.Errorf("backfill account IDs: %w", err)
+	}
+	if err := backfillCurrencies(db); err != nil {
+		return fmt.Errorf("backfill currencies: %w", err)
+	}
+	if err := clearCashRecipients(db); err != nil {
+		return fmt.Errorf("clear debit recipients: %w", err)
+	}
+	if err := backfillOpeningBalances(db); err != nil {
+		return fmt.Errorf("backfill ledger opening balances: %w", err)
+	}
+	return nil
+}
+
 func GetDB() *gorm.DB {
 	return DB
 }
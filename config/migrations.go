@@ -0,0 +1,386 @@
+package config
+
+import (
+	"fmt"
+	"time"
+
+	"bbank/models"
+
+	"gorm.io/gorm"
+)
+
+// Columns that used to hold float64 amounts and now store Money in minor units
+var moneyColumns = []struct {
+	Table  string
+	Column string
+}{
+	{"balances", "amount"},
+	{"transactions", "amount"},
+}
+
+// Convert legacy floating point amount columns to BIGINT minor units.
+// Must run before AutoMigrate, which would otherwise truncate the cents.
+func migrateMoneyColumns(db *gorm.DB) error {
+	for _, mc := range moneyColumns {
+		var dataType string
+		err := db.Raw(`SELECT data_type FROM information_schema.columns
+			WHERE table_schema = CURRENT_SCHEMA() AND table_name = ? AND column_name = ?`,
+			mc.Table, mc.Column).Scan(&dataType).Error
+		if err != nil {
+			return err
+		}
+
+		if dataType != "double precision" && dataType != "real" && dataType != "numeric" {
+			continue
+		}
+
+		sql := fmt.Sprintf(`ALTER TABLE %q ALTER COLUMN %q TYPE bigint USING ROUND(%q * 100)::bigint`,
+			mc.Table, mc.Column, mc.Column)
+		if err := db.Exec(sql).Error; err != nil {
+			return fmt.Errorf("migrate %s.%s to minor units: %w", mc.Table, mc.Column, err)
+		}
+	}
+	return nil
+}
+
+// Give balances that predate the ledger an opening journal entry so that
+// stored balances and postings agree.
+func backfillOpeningBalances(db *gorm.DB) error {
+	var balances []models.Balance
+	err := db.Where("amount <> 0 AND NOT EXISTS (SELECT 1 FROM postings WHERE postings.account_id = balances.account_id)").
+		Find(&balances).Error
+	if err != nil {
+		return err
+	}
+
+	for _, balance := range balances {
+		accountID, userID := balance.AccountID, balance.UserID
+		entry := models.JournalEntry{
+			Description: "opening balance",
+			CreatedAt:   balance.LastUpdatedAt,
+			Postings: []models.Posting{
+				{AccountID: &accountID, UserID: &userID, Currency: balance.Currency, Amount: balance.Amount, CreatedAt: balance.LastUpdatedAt},
+				{SystemAccount: models.SystemAccountOpeningBalance, Currency: balance.Currency, Amount: -balance.Amount, CreatedAt: balance.LastUpdatedAt},
+			},
+		}
+		if err := db.Create(&entry).Error; err != nil {
+			return fmt.Errorf("opening balance for account %d: %w", accountID, err)
+		}
+	}
+	return nil
+}
+
+// Turn the legacy one-balance-per-user table into default accounts. Must
+// run before AutoMigrate because the primary key of balances changes from
+// user_id to account_id.
+func migrateBalancesToAccounts(db *gorm.DB, defaultCurrency string) error {
+	migrator := db.Migrator()
+	if !migrator.HasTable(&models.Balance{}) || migrator.HasColumn(&models.Balance{}, "AccountID") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.AutoMigrate(&models.Account{}); err != nil {
+			return err
+		}
+
+		err := tx.Exec(`INSERT INTO accounts (user_id, number, name, type, currency, status, is_default, created_at, updated_at)
+			SELECT user_id, 'legacy-' || user_id, 'Main', ?, ?, ?, TRUE, NOW(), NOW() FROM balances`,
+			models.AccountTypeChecking, defaultCurrency, models.AccountStatusActive).Error
+		if err != nil {
+			return err
+		}
+
+		var accounts []models.Account
+		if err := tx.Where("number LIKE 'legacy-%'").Find(&accounts).Error; err != nil {
+			return err
+		}
+		for _, account := range accounts {
+			if err := tx.Model(&account).Update("number", models.AccountNumber(account.ID)).Error; err != nil {
+				return err
+			}
+		}
+
+		statements := []string{
+			`ALTER TABLE balances ADD COLUMN account_id bigint`,
+			`UPDATE balances SET account_id = accounts.id FROM accounts
+				WHERE accounts.user_id = balances.user_id AND accounts.is_default`,
+			`ALTER TABLE balances DROP CONSTRAINT IF EXISTS balances_pkey`,
+			`ALTER TABLE balances ADD PRIMARY KEY (account_id)`,
+		}
+		for _, sql := range statements {
+			if err := tx.Exec(sql).Error; err != nil {
+				return fmt.Errorf("migrate balances to accounts: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// Point rows written before accounts existed at the owner's default account
+func backfillAccountIDs(db *gorm.DB) error {
+	statements := []string{
+		`UPDATE postings SET account_id = accounts.id FROM accounts
+			WHERE postings.account_id IS NULL AND postings.user_id = accounts.user_id AND accounts.is_default`,
+		`UPDATE holds SET account_id = accounts.id FROM accounts
+			WHERE holds.account_id IS NULL AND holds.user_id = accounts.user_id AND accounts.is_default`,
+		`UPDATE transactions SET to_account_id = accounts.id FROM accounts
+			WHERE transactions.to_account_id IS NULL AND transactions.to_user_id = accounts.user_id AND accounts.is_default`,
+		`UPDATE transactions SET from_account_id = accounts.id FROM accounts
+			WHERE transactions.from_account_id IS NULL AND transactions.from_user_id = accounts.user_id AND accounts.is_default`,
+	}
+	for _, sql := range statements {
+		if err := db.Exec(sql).Error; err != nil {
+			return fmt.Errorf("backfill account ids: %w", err)
+		}
+	}
+	return nil
+}
+
+// Debits used to name their own account as the recipient, and reversals
+// of credits both accounts. Clear the recipient so that it matches the
+// ledger, where the money goes to the cash system account.
+func clearCashRecipients(db *gorm.DB) error {
+	statements := []string{
+		`UPDATE transactions SET to_user_id = NULL, to_account_id = NULL
+			WHERE type = 'debit' AND to_account_id IS NOT NULL`,
+		`UPDATE transactions SET to_user_id = NULL, to_account_id = NULL
+			FROM transactions original
+			WHERE transactions.original_transaction_id = original.id AND original.type = 'credit'
+				AND transactions.to_account_id IS NOT NULL`,
+	}
+	for _, sql := range statements {
+		if err := db.Exec(sql).Error; err != nil {
+			return fmt.Errorf("clear cash recipients: %w", err)
+		}
+	}
+	return nil
+}
+
+// Fill in the currency of rows written before accounts had one. System legs
+// take the currency of an account leg in the same journal entry.
+func backfillCurrencies(db *gorm.DB) error {
+	statements := []string{
+		`UPDATE balances SET currency = accounts.currency FROM accounts
+			WHERE (balances.currency IS NULL OR balances.currency = '') AND balances.account_id = accounts.id`,
+		`UPDATE holds SET currency = accounts.currency FROM accounts
+			WHERE (holds.currency IS NULL OR holds.currency = '') AND holds.account_id = accounts.id`,
+		`UPDATE postings SET currency = accounts.currency FROM accounts
+			WHERE (postings.currency IS NULL OR postings.currency = '') AND postings.account_id = accounts.id`,
+		`UPDATE postings SET currency = (
+				SELECT sibling.currency FROM postings sibling
+				WHERE sibling.journal_entry_id = postings.journal_entry_id
+					AND sibling.account_id IS NOT NULL AND sibling.currency <> ''
+				LIMIT 1)
+			WHERE (postings.currency IS NULL OR postings.currency = '') AND postings.account_id IS NULL`,
+		`UPDATE transactions SET currency = accounts.currency FROM accounts
+			WHERE (transactions.currency IS NULL OR transactions.currency = '')
+				AND accounts.id = COALESCE(transactions.from_account_id, transactions.to_account_id)`,
+	}
+	for _, sql := range statements {
+		if err := db.Exec(sql).Error; err != nil {
+			return fmt.Errorf("backfill currencies: %w", err)
+		}
+	}
+	return nil
+}
+
+// Users who registered before email verification existed keep access to
+// money movement. Must run before AutoMigrate adds the column.
+func addEmailVerifiedAt(db *gorm.DB) error {
+	migrator := db.Migrator()
+	if !migrator.HasTable(&models.User{}) || migrator.HasColumn(&models.User{}, "EmailVerifiedAt") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Migrator().AddColumn(&models.User{}, "EmailVerifiedAt"); err != nil {
+			return err
+		}
+		return tx.Exec(`UPDATE users SET email_verified_at = created_at`).Error
+	})
+}
+
+// Turn audit_logs into a table partitioned by month of created_at and then
+// by entity type, so that expired months can be archived and dropped.
+// Existing entries are copied after checking the single chain they were
+// written with, and chained again per entity type. Entries from before the
+// chain existed are chained for the first time. Must run before
+// AutoMigrate, which would otherwise create a plain table.
+func partitionAuditLogs(db *gorm.DB, retention AuditRetention) error {
+	var kind string
+	err := db.Raw(`SELECT c.relkind FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = CURRENT_SCHEMA() AND c.relname = 'audit_logs'`).Scan(&kind).Error
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case "p":
+		if err := removeLateAuditPartition(db, retention); err != nil {
+			return err
+		}
+		now := time.Now()
+		return EnsureAuditPartitions(db, retention, now, now)
+	case "", "r":
+	default:
+		return fmt.Errorf("audit_logs has unexpected relation kind %q", kind)
+	}
+	legacy := kind == "r"
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		// Keep the ID sequence so that new entries continue after the old ones
+		sequence := "audit_logs_id_seq"
+		if legacy {
+			if err := tx.Raw(`SELECT pg_get_serial_sequence('audit_logs', 'id')`).Scan(&sequence).Error; err != nil {
+				return err
+			}
+			if sequence == "" {
+				return fmt.Errorf("audit_logs.id has no sequence")
+			}
+			statements := []string{
+				`ALTER TABLE audit_logs RENAME TO audit_logs_legacy`,
+				fmt.Sprintf(`ALTER SEQUENCE %s OWNED BY NONE`, sequence),
+			}
+			for _, sql := range statements {
+				if err := tx.Exec(sql).Error; err != nil {
+					return err
+				}
+			}
+		} else if err := tx.Exec(`CREATE SEQUENCE IF NOT EXISTS audit_logs_id_seq`).Error; err != nil {
+			return err
+		}
+
+		// The partition key has to be part of the primary key
+		err := tx.Exec(fmt.Sprintf(`CREATE TABLE audit_logs (
+			id bigint NOT NULL DEFAULT nextval('%s'),
+			entity_type text NOT NULL,
+			entity_id bigint NOT NULL,
+			action text NOT NULL,
+			details jsonb,
+			created_at timestamptz NOT NULL,
+			prev_hash varchar(64),
+			hash varchar(64),
+			PRIMARY KEY (id, created_at)
+		) PARTITION BY RANGE (created_at)`, sequence)).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Exec(fmt.Sprintf(`ALTER SEQUENCE %s OWNED BY audit_logs.id`, sequence)).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		since := now
+		if legacy {
+			var oldest *time.Time
+			if err := tx.Raw(`SELECT MIN(created_at) FROM audit_logs_legacy`).Scan(&oldest).Error; err != nil {
+				return err
+			}
+			if oldest != nil {
+				since = *oldest
+			}
+		}
+		if err := EnsureAuditPartitions(tx, retention, since, now); err != nil {
+			return err
+		}
+		if !legacy {
+			return nil
+		}
+
+		if err := copyAuditLogs(tx); err != nil {
+			return err
+		}
+		return tx.Exec(`DROP TABLE audit_logs_legacy`).Error
+	})
+}
+
+// Databases partitioned by an earlier version have a DEFAULT partition,
+// audit_logs_late, that took entries dated in archived months. It was never
+// archived and blocks creating a month it holds entries of, so its entries
+// move to the partitions of their months and it is dropped.
+func removeLateAuditPartition(db *gorm.DB, retention AuditRetention) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var exists bool
+		if err := tx.Raw(`SELECT to_regclass('audit_logs_late') IS NOT NULL`).Scan(&exists).Error; err != nil {
+			return err
+		}
+		if !exists {
+			return nil
+		}
+		if err := tx.Exec(`ALTER TABLE audit_logs DETACH PARTITION audit_logs_late`).Error; err != nil {
+			return err
+		}
+
+		var months []struct{ Month time.Time }
+		err := tx.Raw(`SELECT DISTINCT date_trunc('month', created_at, 'UTC') AS month FROM audit_logs_late`).Scan(&months).Error
+		if err != nil {
+			return err
+		}
+		for _, row := range months {
+			if err := EnsureAuditMonth(tx, retention, row.Month); err != nil {
+				return err
+			}
+		}
+
+		statements := []string{
+			`INSERT INTO audit_logs (id, entity_type, entity_id, action, details, created_at, prev_hash, hash)
+				SELECT id, entity_type, entity_id, action, details, created_at, prev_hash, hash FROM audit_logs_late`,
+			`DROP TABLE audit_logs_late`,
+		}
+		for _, sql := range statements {
+			if err := tx.Exec(sql).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// A month restored for late entries is archived again under the same
+// partition name, so archive records stop being unique per partition
+func dropUniqueAuditArchivePartition(db *gorm.DB) error {
+	var unique bool
+	err := db.Raw(`SELECT COALESCE(bool_or(indisunique), false) FROM pg_index
+		WHERE indexrelid = to_regclass('idx_audit_archives_partition')`).Scan(&unique).Error
+	if err != nil || !unique {
+		return err
+	}
+	return db.Exec(`DROP INDEX idx_audit_archives_partition`).Error
+}
+
+// Copy entries from audit_logs_legacy in ID order, checking the old single
+// chain and building one chain per entity type
+func copyAuditLogs(tx *gorm.DB) error {
+	legacyHash := models.AuditGenesisHash
+	heads := make(map[string]string)
+
+	var batch []models.AuditLog
+	return tx.Table("audit_logs_legacy").FindInBatches(&batch, 1000, func(batchTx *gorm.DB, _ int) error {
+		for i := range batch {
+			entry := &batch[i]
+			if entry.Hash != "" {
+				hash, err := entry.ChainHash(legacyHash)
+				if err != nil {
+					return fmt.Errorf("audit entry %d: %w", entry.ID, err)
+				}
+				if entry.PrevHash != legacyHash || hash != entry.Hash {
+					return fmt.Errorf("audit entry %d breaks the chain; run verify-audit before migrating", entry.ID)
+				}
+				legacyHash = entry.Hash
+			}
+
+			prevHash, ok := heads[entry.EntityType]
+			if !ok {
+				prevHash = models.AuditGenesisHash
+			}
+			hash, err := entry.ChainHash(prevHash)
+			if err != nil {
+				return fmt.Errorf("audit entry %d: %w", entry.ID, err)
+			}
+			entry.PrevHash = prevHash
+			entry.Hash = hash
+			heads[entry.EntityType] = hash
+		}
+		return tx.Create(&batch).Error
+	}).Error
+}
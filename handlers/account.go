@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"bbank/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AccountHandler struct {
+	accountService *services.AccountService
+}
+
+func NewAccountHandler(accountService *services.AccountService) *AccountHandler {
+	return &AccountHandler{
+		accountService: accountService,
+	}
+}
+
+// Open a new account
+func (h *AccountHandler) CreateAccount(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+
+	var req services.CreateAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	account, err := h.accountService.CreateAccount(userID, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, account)
+}
+
+// List the user's accounts
+func (h *AccountHandler) GetAccounts(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+
+	accounts, err := h.accountService.GetUserAccounts(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"accounts": accounts,
+		"count":    len(accounts),
+	})
+}
+
+// Get single account
+func (h *AccountHandler) GetAccount(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+
+	accountID, ok := getAccountIDFromParam(c)
+	if !ok {
+		return
+	}
+
+	account, err := h.accountService.GetAccount(userID, accountID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, account)
+}
+
+// Update account details
+func (h *AccountHandler) UpdateAccount(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+
+	accountID, ok := getAccountIDFromParam(c)
+	if !ok {
+		return
+	}
+
+	var req services.UpdateAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	account, err := h.accountService.UpdateAccount(userID, accountID, req)
+	if err != nil {
+		c.JSON(accountErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, account)
+}
+
+// Freeze or unfreeze a customer's account
+func (h *AccountHandler) SetAccountStatus(c *gin.Context) {
+	staffID := getUserIDFromContext(c)
+
+	accountID, ok := getAccountIDFromParam(c)
+	if !ok {
+		return
+	}
+
+	var req services.AccountStatusRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	account, err := h.accountService.SetAccountStatus(accountID, req.Status, staffID)
+	if err != nil {
+		c.JSON(accountErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, account)
+}
+
+// Close an account
+func (h *AccountHandler) CloseAccount(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+
+	accountID, ok := getAccountIDFromParam(c)
+	if !ok {
+		return
+	}
+
+	if err := h.accountService.CloseAccount(userID, accountID); err != nil {
+		c.JSON(accountErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusNoContent, nil)
+}
+
+func getAccountIDFromParam(c *gin.Context) (uint, bool) {
+	accountID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return 0, false
+	}
+	return uint(accountID), true
+}
+
+func accountErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrAccountNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, services.ErrAccountNotActive):
+		return http.StatusConflict
+	case errors.Is(err, services.ErrUnfreezeForbidden):
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"bbank/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Create an API key for the current user; the key is only shown here
+func (h *AuthHandler) CreateAPIKey(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+
+	var req services.CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	created, err := h.authService.CreateAPIKey(userID, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, created)
+}
+
+// List the API keys of the current user
+func (h *AuthHandler) GetAPIKeys(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+
+	keys, err := h.authService.GetAPIKeys(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"api_keys": keys,
+		"count":    len(keys),
+	})
+}
+
+// Revoke an API key of the current user
+func (h *AuthHandler) RevokeAPIKey(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+
+	keyID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key ID"})
+		return
+	}
+
+	if err := h.authService.RevokeAPIKey(userID, uint(keyID)); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, services.ErrAPIKeyNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusNoContent, nil)
+}
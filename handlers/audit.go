@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bbank/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AuditHandler struct {
+	auditService *services.AuditService
+	auditWriter  *services.AuditWriter
+}
+
+func NewAuditHandler(auditService *services.AuditService, auditWriter *services.AuditWriter) *AuditHandler {
+	return &AuditHandler{
+		auditService: auditService,
+		auditWriter:  auditWriter,
+	}
+}
+
+// Report the queue length and counters of the asynchronous audit writer
+func (h *AuditHandler) GetWriterStats(c *gin.Context) {
+	c.JSON(http.StatusOK, h.auditWriter.Stats())
+}
+
+// Search the audit log, newest first. Filters: entity_type, entity_id,
+// action, from and to (RFC 3339) and details.<path>=<value>; pages follow
+// next_cursor.
+func (h *AuditHandler) GetAuditLogs(c *gin.Context) {
+	query, err := parseAuditQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "0"))
+
+	page, err := h.auditService.Search(query, c.Query("cursor"), limit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+// Stream the matching audit entries as CSV or NDJSON (format parameter)
+func (h *AuditHandler) ExportAuditLogs(c *gin.Context) {
+	query, err := parseAuditQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	format := c.DefaultQuery("format", services.AuditFormatNDJSON)
+	contentType := "application/x-ndjson"
+	switch format {
+	case services.AuditFormatNDJSON:
+	case services.AuditFormatCSV:
+		contentType = "text/csv"
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or ndjson"})
+		return
+	}
+
+	filename := fmt.Sprintf("audit-logs-%s.%s", time.Now().UTC().Format("20060102T150405Z"), format)
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Status(http.StatusOK)
+
+	// Headers are sent with the first batch, so later errors can only cut
+	// the download short
+	if err := h.auditService.Export(c.Writer, query, format, getUserIDFromContext(c)); err != nil {
+		log.Printf("Audit export failed: %v", err)
+	}
+}
+
+func parseAuditQuery(c *gin.Context) (services.AuditQuery, error) {
+	query := services.AuditQuery{
+		EntityType: c.Query("entity_type"),
+		Action:     c.Query("action"),
+	}
+
+	if value := c.Query("entity_id"); value != "" {
+		id, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return query, fmt.Errorf("invalid entity_id %q", value)
+		}
+		entityID := uint(id)
+		query.EntityID = &entityID
+	}
+
+	for name, target := range map[string]**time.Time{"from": &query.From, "to": &query.To} {
+		if value := c.Query(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return query, fmt.Errorf("invalid %s, use RFC 3339", name)
+			}
+			*target = &t
+		}
+	}
+
+	for key, values := range c.Request.URL.Query() {
+		if path, ok := strings.CutPrefix(key, "details."); ok && len(values) > 0 {
+			if query.Details == nil {
+				query.Details = map[string]string{}
+			}
+			query.Details[path] = values[0]
+		}
+	}
+	return query, nil
+}
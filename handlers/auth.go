@@ -1,10 +1,13 @@
 package handlers
 
 import (
+	"errors"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"bbank/middleware"
-	"bbank/models"
 	"bbank/services"
 
 	"github.com/gin-gonic/gin"
@@ -28,7 +31,7 @@ func (h *AuthHandler) Register(c *gin.Context) {
 		return
 	}
 
-	response, err := h.authService.Register(req)
+	response, err := h.authService.Register(req, getClientInfo(c))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -45,9 +48,15 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
-	response, err := h.authService.Login(req)
+	response, challenge, err := h.authService.Login(req, getClientInfo(c))
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		c.JSON(loginErrorStatus(c, err), gin.H{"error": err.Error()})
+		return
+	}
+
+	// The second step continues at /auth/2fa/login
+	if challenge != nil {
+		c.JSON(http.StatusOK, challenge)
 		return
 	}
 
@@ -79,21 +88,27 @@ func (h *AuthHandler) GetUser(c *gin.Context) {
 	c.JSON(http.StatusOK, user)
 }
 
+// Update the fields present in the request body
 func (h *AuthHandler) UpdateUser(c *gin.Context) {
 	userID, ok := middleware.GetUserIDFromParam(c)
 	if !ok {
 		return // Hata zaten middleware fonksiyon içinde döndü
 	}
 
-	var updatedUser models.User
-	if err := c.ShouldBindJSON(&updatedUser); err != nil {
+	var req services.UpdateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	user, err := h.authService.UpdateUser(userID, updatedUser)
+	actor := services.AccessClaims{
+		UserID:    getUserIDFromContext(c),
+		Role:      c.GetString("role"),
+		SessionID: c.GetString("session_id"),
+	}
+	user, err := h.authService.UpdateUser(userID, req, actor, getClientInfo(c))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(userUpdateErrorStatus(c, err), gin.H{"error": err.Error()})
 		return
 	}
 
@@ -106,7 +121,7 @@ func (h *AuthHandler) DeleteUser(c *gin.Context) {
 		return // Hata zaten middleware fonksiyon içinde döndü
 	}
 
-	if err := h.authService.DeleteUser(userID); err != nil {
+	if err := h.authService.DeleteUser(userID, getUserIDFromContext(c)); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -114,24 +129,31 @@ func (h *AuthHandler) DeleteUser(c *gin.Context) {
 	c.JSON(http.StatusNoContent, nil)
 }
 
-func (h *AuthHandler) RefreshToken(c *gin.Context) {
-	var req struct {
-		RefreshToken string `json:"refresh_token"`
+// Lift a login lockout of a user
+func (h *AuthHandler) UnlockUser(c *gin.Context) {
+	userID, ok := middleware.GetUserIDFromParam(c)
+	if !ok {
+		return
 	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+
+	if err := h.authService.UnlockUser(userID, getUserIDFromContext(c)); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
 
-	userID, err := h.authService.ValidateRefreshToken(req.RefreshToken)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	c.JSON(http.StatusOK, gin.H{"message": "User unlocked"})
+}
+
+func (h *AuthHandler) RefreshToken(c *gin.Context) {
+	var req services.RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	accessToken, refreshToken, err := h.authService.GenerateToken(userID)
+	accessToken, refreshToken, err := h.authService.RotateRefreshToken(req.RefreshToken, getClientInfo(c))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 		return
 	}
 
@@ -140,3 +162,63 @@ func (h *AuthHandler) RefreshToken(c *gin.Context) {
 		"refresh_token": refreshToken,
 	})
 }
+
+// Revoke the refresh token and every token rotated from the same login
+func (h *AuthHandler) Logout(c *gin.Context) {
+	var req services.RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.authService.Logout(req.RefreshToken); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+// Revoke every refresh token of the current user
+func (h *AuthHandler) LogoutAll(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+
+	if err := h.authService.LogoutAll(userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out of all sessions"})
+}
+
+// Throttled logins get 429 with a Retry-After header, other failures 401
+func loginErrorStatus(c *gin.Context, err error) int {
+	var blocked *services.LoginBlockedError
+	if errors.As(err, &blocked) {
+		retryAfter := int(math.Ceil(time.Until(blocked.Until).Seconds()))
+		c.Header("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+		return http.StatusTooManyRequests
+	}
+	return http.StatusUnauthorized
+}
+
+func userUpdateErrorStatus(c *gin.Context, err error) int {
+	var policyErr *services.PasswordPolicyError
+	var blocked *services.LoginBlockedError
+	switch {
+	case errors.As(err, &blocked):
+		return loginErrorStatus(c, err)
+	case errors.As(err, &policyErr),
+		errors.Is(err, services.ErrCurrentPasswordRequired),
+		errors.Is(err, services.ErrUnknownRole):
+		return http.StatusBadRequest
+	case errors.Is(err, services.ErrWrongCurrentPassword),
+		errors.Is(err, services.ErrFieldForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, services.ErrUserNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, services.ErrUserExists):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
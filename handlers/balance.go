@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"net/http"
+	"strconv"
 	"time"
 
 	"bbank/services"
@@ -11,30 +12,46 @@ import (
 
 type BalanceHandler struct {
 	balanceService *services.BalanceService
+	accountService *services.AccountService
 }
 
-func NewBalanceHandler(balanceService *services.BalanceService) *BalanceHandler {
+func NewBalanceHandler(balanceService *services.BalanceService, accountService *services.AccountService) *BalanceHandler {
 	return &BalanceHandler{
 		balanceService: balanceService,
+		accountService: accountService,
 	}
 }
 
 // Get current balance
 func (h *BalanceHandler) GetCurrentBalance(c *gin.Context) {
-	userID := getUserIDFromContext(c)
+	accountID, ok := h.getAccountIDFromQuery(c)
+	if !ok {
+		return
+	}
 
-	balance, err := h.balanceService.GetBalance(userID)
+	balance, err := h.balanceService.GetBalance(accountID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, balance)
+	c.JSON(http.StatusOK, gin.H{
+		"account_id":      balance.AccountID,
+		"user_id":         balance.UserID,
+		"currency":        balance.Currency,
+		"ledger":          balance.Amount,
+		"available":       balance.Available(),
+		"held":            balance.HeldAmount,
+		"last_updated_at": balance.LastUpdatedAt,
+	})
 }
 
 // Get historical balance
 func (h *BalanceHandler) GetHistoricalBalance(c *gin.Context) {
-	userID := getUserIDFromContext(c)
+	accountID, ok := h.getAccountIDFromQuery(c)
+	if !ok {
+		return
+	}
 
 	// Parse timestamp from query param
 	timeParam := c.Query("at")
@@ -49,7 +66,7 @@ func (h *BalanceHandler) GetHistoricalBalance(c *gin.Context) {
 		return
 	}
 
-	balance, err := h.balanceService.GetBalanceAtTime(userID, timestamp)
+	balance, err := h.balanceService.GetBalanceAtTime(accountID, timestamp)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -63,7 +80,10 @@ func (h *BalanceHandler) GetHistoricalBalance(c *gin.Context) {
 
 // Get balance at specific time
 func (h *BalanceHandler) GetBalanceAtTime(c *gin.Context) {
-	userID := getUserIDFromContext(c)
+	accountID, ok := h.getAccountIDFromQuery(c)
+	if !ok {
+		return
+	}
 
 	timeStr := c.Query("time")
 	if timeStr == "" {
@@ -77,7 +97,7 @@ func (h *BalanceHandler) GetBalanceAtTime(c *gin.Context) {
 		return
 	}
 
-	balance, err := h.balanceService.GetBalanceAtTime(userID, timestamp)
+	balance, err := h.balanceService.GetBalanceAtTime(accountID, timestamp)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
@@ -88,3 +108,43 @@ func (h *BalanceHandler) GetBalanceAtTime(c *gin.Context) {
 		"timestamp": timestamp,
 	})
 }
+
+// Verify current balance against the ledger
+func (h *BalanceHandler) VerifyBalance(c *gin.Context) {
+	accountID, ok := h.getAccountIDFromQuery(c)
+	if !ok {
+		return
+	}
+
+	verification, err := h.balanceService.VerifyBalance(accountID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, verification)
+}
+
+// Resolve the optional account_id query parameter to one of the user's
+// accounts; without it the default account is used
+func (h *BalanceHandler) getAccountIDFromQuery(c *gin.Context) (uint, bool) {
+	userID := getUserIDFromContext(c)
+
+	var accountID *uint
+	if param := c.Query("account_id"); param != "" {
+		id, err := strconv.ParseUint(param, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+			return 0, false
+		}
+		parsed := uint(id)
+		accountID = &parsed
+	}
+
+	resolved, err := h.accountService.ResolveAccountID(userID, accountID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return 0, false
+	}
+	return resolved, true
+}
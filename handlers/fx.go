@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"net/http"
+
+	"bbank/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+type FXHandler struct {
+	fxService *services.FXService
+}
+
+func NewFXHandler(fxService *services.FXService) *FXHandler {
+	return &FXHandler{
+		fxService: fxService,
+	}
+}
+
+// List the current exchange rates
+func (h *FXHandler) GetRates(c *gin.Context) {
+	rates, err := h.fxService.GetRates()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"rates": rates,
+		"count": len(rates),
+	})
+}
+
+// Insert or replace exchange rates
+func (h *FXHandler) SetRates(c *gin.Context) {
+	var req services.SetRatesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rates, err := h.fxService.SetRates(req.Rates)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Exchange rates updated",
+		"rates":   rates,
+	})
+}
@@ -1,6 +1,11 @@
 package handlers
 
 import (
+	"errors"
+	"net/http"
+
+	"bbank/services"
+
 	"github.com/gin-gonic/gin"
 )
 
@@ -12,3 +17,33 @@ func getUserIDFromContext(c *gin.Context) uint {
 	}
 	return userID.(uint)
 }
+
+// Describe the client of the request for session tracking
+func getClientInfo(c *gin.Context) services.ClientInfo {
+	return services.ClientInfo{
+		IPAddress: c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	}
+}
+
+// Map errors from money-moving services to HTTP status codes
+func transactionErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrBalanceConflict),
+		errors.Is(err, services.ErrNotRefundable),
+		errors.Is(err, services.ErrHoldNotActive),
+		errors.Is(err, services.ErrHoldExpired):
+		return http.StatusConflict
+	case errors.Is(err, services.ErrAccountNotActive):
+		return http.StatusConflict
+	case errors.Is(err, services.ErrTransactionNotFound),
+		errors.Is(err, services.ErrHoldNotFound),
+		errors.Is(err, services.ErrAccountNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, services.ErrRateNotFound):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, services.ErrOwnTransaction):
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"bbank/models"
+	"bbank/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Place a hold on funds
+func (h *TransactionHandler) CreateHold(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+
+	var req services.HoldRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	accountID, err := h.accountService.ResolveAccountID(userID, req.AccountID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	hold, err := h.transactionService.CreateHold(userID, accountID, req.Amount, req.Currency, req.Description)
+	if err != nil {
+		c.JSON(transactionErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Hold created",
+		"hold":    hold,
+	})
+}
+
+// Capture a hold in full or in part
+func (h *TransactionHandler) CaptureHold(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+
+	holdID, ok := getHoldIDFromParam(c)
+	if !ok {
+		return
+	}
+
+	// The body is optional, without an amount the full hold is captured
+	var req services.CaptureRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var amount models.Money
+	if req.Amount != nil {
+		if *req.Amount <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "amount must be positive"})
+			return
+		}
+		amount = *req.Amount
+	}
+
+	transaction, err := h.transactionService.CaptureHold(holdID, userID, amount)
+	if err != nil {
+		c.JSON(transactionErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":     "Hold captured",
+		"transaction": transaction,
+	})
+}
+
+// Release a hold without spending it
+func (h *TransactionHandler) ReleaseHold(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+
+	holdID, ok := getHoldIDFromParam(c)
+	if !ok {
+		return
+	}
+
+	hold, err := h.transactionService.ReleaseHold(holdID, userID)
+	if err != nil {
+		c.JSON(transactionErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Hold released",
+		"hold":    hold,
+	})
+}
+
+// Get single hold
+func (h *TransactionHandler) GetHold(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+
+	holdID, ok := getHoldIDFromParam(c)
+	if !ok {
+		return
+	}
+
+	hold, err := h.transactionService.GetHold(holdID, userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, hold)
+}
+
+// Get active holds
+func (h *TransactionHandler) GetActiveHolds(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+
+	holds, err := h.transactionService.GetActiveHolds(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"holds": holds,
+		"count": len(holds),
+	})
+}
+
+func getHoldIDFromParam(c *gin.Context) (uint, bool) {
+	holdID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid hold ID"})
+		return 0, false
+	}
+	return uint(holdID), true
+}
@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"net/http"
+
+	"bbank/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+type JWKSHandler struct {
+	keys *services.KeyManager
+}
+
+func NewJWKSHandler(keys *services.KeyManager) *JWKSHandler {
+	return &JWKSHandler{
+		keys: keys,
+	}
+}
+
+// Publish the public keys that verify access and refresh tokens
+func (h *JWKSHandler) GetJWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, h.keys.JWKS())
+}
@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"bbank/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Register a third-party app; a confidential client's secret is only shown here
+func (h *AuthHandler) RegisterOAuthClient(c *gin.Context) {
+	adminID := getUserIDFromContext(c)
+
+	var req services.RegisterOAuthClientRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	registered, err := h.authService.RegisterOAuthClient(adminID, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, registered)
+}
+
+// List registered third-party apps
+func (h *AuthHandler) GetOAuthClients(c *gin.Context) {
+	clients, err := h.authService.GetOAuthClients()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"clients": clients,
+		"count":   len(clients),
+	})
+}
+
+// Revoke a third-party app
+func (h *AuthHandler) RevokeOAuthClient(c *gin.Context) {
+	adminID := getUserIDFromContext(c)
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid client ID"})
+		return
+	}
+
+	if err := h.authService.RevokeOAuthClient(adminID, uint(id)); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, services.ErrOAuthClientNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// Describe an authorization request so the frontend can ask for consent
+func (h *AuthHandler) GetAuthorization(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+
+	var req services.AuthorizeRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	prompt, err := h.authService.PrepareAuthorization(userID, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, prompt)
+}
+
+// Approve or deny an authorization request; the frontend sends the user
+// on to the returned redirect URI
+func (h *AuthHandler) Authorize(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+
+	var req services.AuthorizeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	redirectURI, err := h.authService.Authorize(userID, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"redirect_uri": redirectURI})
+}
+
+// OAuth2 token endpoint. Clients authenticate with HTTP Basic or with
+// client_id and client_secret in the form.
+func (h *AuthHandler) OAuthToken(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	var req services.OAuthTokenRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, services.OAuthError{Code: "invalid_request", Description: err.Error()})
+		return
+	}
+	if id, secret, ok := c.Request.BasicAuth(); ok {
+		req.ClientID, req.ClientSecret = id, secret
+	}
+
+	response, err := h.authService.ExchangeOAuthToken(req)
+	if err != nil {
+		var oauthErr *services.OAuthError
+		if !errors.As(err, &oauthErr) {
+			c.JSON(http.StatusInternalServerError, services.OAuthError{Code: "server_error"})
+			return
+		}
+		if oauthErr.Code == "invalid_client" {
+			c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+		}
+		c.JSON(oauthErr.Status(), oauthErr)
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// List the third-party apps the current user has approved
+func (h *AuthHandler) GetOAuthConsents(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+
+	consents, err := h.authService.GetOAuthConsents(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"consents": consents,
+		"count":    len(consents),
+	})
+}
+
+// Withdraw the current user's approval of a third-party app
+func (h *AuthHandler) RevokeOAuthConsent(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid consent ID"})
+		return
+	}
+
+	if err := h.authService.RevokeOAuthConsent(userID, uint(id)); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, services.ErrOAuthConsentNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusNoContent, nil)
+}
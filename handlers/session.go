@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"bbank/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// List the active sessions of the current user
+func (h *AuthHandler) GetSessions(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+
+	sessions, err := h.authService.GetActiveSessions(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"sessions":        sessions,
+		"count":           len(sessions),
+		"current_session": c.GetString("session_id"),
+	})
+}
+
+// Revoke one of the current user's sessions
+func (h *AuthHandler) RevokeSession(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+
+	if err := h.authService.RevokeSession(userID, c.Param("id")); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, services.ErrSessionNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusNoContent, nil)
+}
@@ -4,7 +4,6 @@ import (
 	"net/http"
 	"strconv"
 
-	"bbank/middleware"
 	"bbank/services"
 
 	"github.com/gin-gonic/gin"
@@ -12,11 +11,13 @@ import (
 
 type TransactionHandler struct {
 	transactionService *services.TransactionService
+	accountService     *services.AccountService
 }
 
-func NewTransactionHandler(transactionService *services.TransactionService) *TransactionHandler {
+func NewTransactionHandler(transactionService *services.TransactionService, accountService *services.AccountService) *TransactionHandler {
 	return &TransactionHandler{
 		transactionService: transactionService,
+		accountService:     accountService,
 	}
 }
 
@@ -30,9 +31,15 @@ func (h *TransactionHandler) Credit(c *gin.Context) {
 		return
 	}
 
-	transaction, err := h.transactionService.Credit(userID, req.Amount)
+	accountID, err := h.accountService.ResolveAccountID(userID, req.AccountID)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	transaction, err := h.transactionService.Credit(userID, accountID, req.Amount, req.Currency)
+	if err != nil {
+		c.JSON(transactionErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
@@ -52,9 +59,15 @@ func (h *TransactionHandler) Debit(c *gin.Context) {
 		return
 	}
 
-	transaction, err := h.transactionService.Debit(userID, req.Amount)
+	accountID, err := h.accountService.ResolveAccountID(userID, req.AccountID)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	transaction, err := h.transactionService.Debit(userID, accountID, req.Amount, req.Currency)
+	if err != nil {
+		c.JSON(transactionErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
@@ -74,9 +87,21 @@ func (h *TransactionHandler) Transfer(c *gin.Context) {
 		return
 	}
 
-	transaction, err := h.transactionService.Transfer(fromUserID, req.ToUserID, req.Amount)
+	fromAccountID, err := h.accountService.ResolveAccountID(fromUserID, req.FromAccountID)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.JSON(http.StatusNotFound, gin.H{"error": "sender account not found"})
+		return
+	}
+
+	toAccountID, err := h.accountService.ResolveRecipientAccountID(req.ToUserID, req.ToAccountID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	transaction, err := h.transactionService.Transfer(fromUserID, fromAccountID, toAccountID, req.Amount, req.Currency)
+	if err != nil {
+		c.JSON(transactionErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
@@ -111,23 +136,75 @@ func (h *TransactionHandler) GetHistory(c *gin.Context) {
 
 // Get single transaction
 func (h *TransactionHandler) GetTransaction(c *gin.Context) {
-	userID, ok := middleware.GetUserIDFromParam(c)
+	userID := getUserIDFromContext(c)
+
+	transactionID, ok := getTransactionIDFromParam(c)
 	if !ok {
 		return
 	}
 
-	transactionIDStr := c.Param("id")
-	transactionID, err := strconv.ParseUint(transactionIDStr, 10, 32)
+	transaction, err := h.transactionService.GetTransaction(transactionID, userID)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid transaction ID"})
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
 
-	transaction, err := h.transactionService.GetTransaction(uint(transactionID), userID)
+	c.JSON(http.StatusOK, transaction)
+}
+
+// Reverse a customer's transaction in full
+func (h *TransactionHandler) Reverse(c *gin.Context) {
+	staffID := getUserIDFromContext(c)
+
+	transactionID, ok := getTransactionIDFromParam(c)
+	if !ok {
+		return
+	}
+
+	transaction, err := h.transactionService.Reverse(transactionID, staffID)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		c.JSON(transactionErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, transaction)
+	c.JSON(http.StatusCreated, gin.H{
+		"message":     "Reversal successful",
+		"transaction": transaction,
+	})
+}
+
+// Refund part of a customer's transaction
+func (h *TransactionHandler) Refund(c *gin.Context) {
+	staffID := getUserIDFromContext(c)
+
+	transactionID, ok := getTransactionIDFromParam(c)
+	if !ok {
+		return
+	}
+
+	var req services.RefundRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	transaction, err := h.transactionService.Refund(transactionID, staffID, req.Amount)
+	if err != nil {
+		c.JSON(transactionErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":     "Refund successful",
+		"transaction": transaction,
+	})
+}
+
+func getTransactionIDFromParam(c *gin.Context) (uint, bool) {
+	transactionID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid transaction ID"})
+		return 0, false
+	}
+	return uint(transactionID), true
 }
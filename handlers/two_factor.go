@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"bbank/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Start TOTP enrollment and return the secret for the authenticator app
+func (h *AuthHandler) SetupTwoFactor(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+
+	setup, err := h.authService.SetupTOTP(userID)
+	if err != nil {
+		c.JSON(twoFactorErrorStatus(c, err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, setup)
+}
+
+// Confirm TOTP enrollment with a first code and hand out recovery codes
+func (h *AuthHandler) VerifyTwoFactor(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+
+	var req services.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	codes, err := h.authService.EnableTOTP(userID, req.Code, getClientInfo(c))
+	if err != nil {
+		c.JSON(twoFactorErrorStatus(c, err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// Second step of a login for users with 2FA enabled
+func (h *AuthHandler) TwoFactorLogin(c *gin.Context) {
+	var req services.TwoFactorLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	response, err := h.authService.CompleteTwoFactorLogin(req, getClientInfo(c))
+	if err != nil {
+		c.JSON(loginErrorStatus(c, err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func twoFactorErrorStatus(c *gin.Context, err error) int {
+	var blocked *services.LoginBlockedError
+	switch {
+	case errors.As(err, &blocked):
+		return loginErrorStatus(c, err)
+	case errors.Is(err, services.ErrTwoFactorAlreadyEnabled):
+		return http.StatusConflict
+	case errors.Is(err, services.ErrInvalidTwoFactorCode):
+		return http.StatusUnauthorized
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"bbank/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Mail a password reset link; answers the same whether or not the email exists
+func (h *AuthHandler) ForgotPassword(c *gin.Context) {
+	var req services.ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	h.authService.ForgotPassword(req.Email)
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "If an account exists for this email, a reset link has been sent"})
+}
+
+// Set a new password with a reset token
+func (h *AuthHandler) ResetPassword(c *gin.Context) {
+	var req services.ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.authService.ResetPassword(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password has been reset, please log in again"})
+}
+
+// Confirm an email address with the token from the verification mail
+func (h *AuthHandler) VerifyEmail(c *gin.Context) {
+	var req services.VerifyEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.authService.VerifyEmail(req.Token); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email address verified"})
+}
+
+// Send the verification mail of the current user again
+func (h *AuthHandler) ResendVerification(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+
+	if err := h.authService.SendVerificationEmail(userID); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, services.ErrEmailAlreadyVerified) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Verification email sent"})
+}
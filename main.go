@@ -1,9 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+
 	"bbank/config"
 	"bbank/handlers"
 	"bbank/middleware"
+	"bbank/models"
 	"bbank/services"
 
 	"github.com/gin-gonic/gin"
@@ -13,64 +24,293 @@ func main() {
 	// Connect to database
 	config.ConnectDatabase()
 
+	// "verify-audit" checks the audit log hash chain instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "verify-audit" {
+		os.Exit(verifyAudit())
+	}
+
 	// Load config
 	cfg := config.LoadConfig()
 
+	lockMode, err := services.ParseLockMode(cfg.BalanceLockMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	stepUpAmount, err := models.ParseMoney(cfg.StepUpAmount)
+	if err != nil {
+		log.Fatalf("Invalid TRANSFER_STEP_UP_AMOUNT %q: %v", cfg.StepUpAmount, err)
+	}
+	if cfg.Argon2Iterations < 1 || cfg.Argon2Threads < 1 || cfg.Argon2Threads > 255 || cfg.Argon2Memory < 8*cfg.Argon2Threads {
+		log.Fatal("Invalid ARGON2_* settings")
+	}
+	if !models.IsSupportedCurrency(cfg.DefaultCurrency) {
+		log.Fatalf("Unsupported DEFAULT_CURRENCY %q", cfg.DefaultCurrency)
+	}
+
+	// Outside debug mode tokens must survive restarts and verify on every replica
+	keyManager, err := services.NewKeyManager(cfg.JWTSigningKeys, cfg.JWTKeyOverlap, gin.Mode() == gin.DebugMode)
+	if err != nil {
+		log.Fatal("Failed to load JWT signing keys:", err)
+	}
+
 	// Initialize services
-	authService := services.NewAuthService(config.GetDB(), cfg.JWTSecret)
-	balanceService := services.NewBalanceService(config.GetDB())
-	transactionService := services.NewTransactionService(config.GetDB(), balanceService)
+	accountService := services.NewAccountService(config.GetDB(), cfg.DefaultCurrency)
+	loginPolicy := services.LoginPolicy{
+		MaxAccountFailures: cfg.LoginMaxFailures,
+		MaxIPFailures:      cfg.LoginMaxPerIP,
+		Lockout:            cfg.LoginLockout,
+		BaseDelay:          cfg.LoginBaseDelay,
+		MaxDelay:           cfg.LoginMaxDelay,
+	}
+	passwordPolicy := services.PasswordPolicy{
+		MinLength:  cfg.PasswordMinLength,
+		MinClasses: cfg.PasswordClasses,
+		History:    cfg.PasswordHistory,
+		Argon2: services.Argon2Params{
+			Memory:     uint32(cfg.Argon2Memory),
+			Iterations: uint32(cfg.Argon2Iterations),
+			Threads:    uint8(cfg.Argon2Threads),
+		},
+	}
+	if cfg.BreachedFile != "" {
+		passwordPolicy.Breached, err = services.LoadBreachedPasswords(cfg.BreachedFile)
+		if err != nil {
+			log.Fatal("Failed to load breached passwords:", err)
+		}
+	}
+	var mailer services.Mailer
+	switch cfg.MailDriver {
+	case "smtp":
+		mailer = services.NewSMTPMailer(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUsername, cfg.SMTPPassword, cfg.MailFrom)
+	case "log":
+		mailer, err = services.NewLogMailer(cfg.MailDir, cfg.MailFrom)
+		if err != nil {
+			log.Fatal("Failed to set up mail directory:", err)
+		}
+	default:
+		log.Fatalf("Unknown MAIL_DRIVER %q", cfg.MailDriver)
+	}
+
+	auditRetention, err := config.ParseAuditRetention(cfg.AuditRetention)
+	if err != nil {
+		log.Fatal(err)
+	}
+	auditOverflow, err := services.ParseAuditOverflow(cfg.AuditOverflow)
+	if err != nil {
+		log.Fatal(err)
+	}
+	auditWriter, err := services.NewAuditWriter(config.GetDB(), services.AuditWriterConfig{
+		QueueSize:  cfg.AuditQueueSize,
+		BatchSize:  cfg.AuditBatchSize,
+		FlushEvery: cfg.AuditFlushEvery,
+		Overflow:   auditOverflow,
+		SpillFile:  cfg.AuditSpillFile,
+		Retention:  auditRetention,
+	})
+	if err != nil {
+		log.Fatal("Failed to start audit writer:", err)
+	}
+
+	authService := services.NewAuthService(config.GetDB(), keyManager, cfg.RefreshTokenTTL, loginPolicy, passwordPolicy, accountService, mailer, cfg.AppBaseURL, auditWriter)
+	ledgerService := services.NewLedgerService(config.GetDB())
+	balanceService := services.NewBalanceService(config.GetDB(), ledgerService, lockMode, cfg.BalanceMaxRetries)
+	fxService, err := services.NewFXService(config.GetDB(), cfg.FXSpread)
+	if err != nil {
+		log.Fatal(err)
+	}
+	transactionService := services.NewTransactionService(config.GetDB(), balanceService, ledgerService, fxService, cfg.HoldTTL)
+	idempotencyService := services.NewIdempotencyService(config.GetDB())
+	auditService := services.NewAuditService(config.GetDB())
+
+	if cfg.AdminEmail != "" {
+		if err := authService.EnsureAdmin(cfg.AdminEmail); err != nil {
+			log.Fatal("Failed to bootstrap admin:", err)
+		}
+	}
+
+	if cfg.FXRatesFile != "" {
+		if err := fxService.LoadRatesFile(cfg.FXRatesFile); err != nil {
+			log.Fatal("Failed to load exchange rates:", err)
+		}
+	}
+
+	// Release holds that were neither captured nor released in time
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go transactionService.RunHoldExpiry(ctx, cfg.HoldExpiryEvery)
+
+	// Forget login throttles once their failures and lock have run out
+	go authService.RunThrottlePurge(ctx, cfg.LoginLockout)
+
+	// Create upcoming audit partitions and archive expired ones
+	auditArchiver, err := services.NewAuditArchiver(config.GetDB(), services.AuditArchiveConfig{
+		Dir:       cfg.AuditArchiveDir,
+		Retention: auditRetention,
+	})
+	if err != nil {
+		log.Fatal("Failed to set up audit archive:", err)
+	}
+	go auditArchiver.Run(ctx, cfg.AuditArchiveEvery)
 
 	// Initialize handlers
 	authHandler := handlers.NewAuthHandler(authService)
-	balanceHandler := handlers.NewBalanceHandler(balanceService)
-	transactionHandler := handlers.NewTransactionHandler(transactionService)
+	jwksHandler := handlers.NewJWKSHandler(keyManager)
+	accountHandler := handlers.NewAccountHandler(accountService)
+	balanceHandler := handlers.NewBalanceHandler(balanceService, accountService)
+	transactionHandler := handlers.NewTransactionHandler(transactionService, accountService)
+	fxHandler := handlers.NewFXHandler(fxService)
+	auditHandler := handlers.NewAuditHandler(auditService, auditWriter)
 
 	// Setup Gin router
 	r := gin.Default()
+	// Client IPs feed login throttling and API key allow-lists, so only
+	// believe X-Forwarded-For from the configured proxies
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES %q: %v", cfg.TrustedProxies, err)
+	}
 
+	// Request IDs first, so the audit entry and the response carry the same one
+	r.Use(middleware.RequestID())
 	// Middleware for logging
-	r.Use(middleware.AuditLogger(config.GetDB()))
+	r.Use(middleware.AuditLogger(auditWriter))
 	// Middleware for CORS
 	r.Use(middleware.CORSMiddleware())
 
+	// Public keys for verifying our tokens
+	r.GET("/.well-known/jwks.json", jwksHandler.GetJWKS)
+
+	requireAuth := middleware.AuthMiddleware(authService)
+	userOnly := middleware.RejectScoped()
+
 	// Public routes
 	auth := r.Group("/api/v1/auth")
 	{
 		auth.POST("/register", authHandler.Register)
 		auth.POST("/login", authHandler.Login)
 		auth.POST("/refresh", authHandler.RefreshToken)
+		auth.POST("/logout", authHandler.Logout)
+		auth.POST("/logout-all", requireAuth, userOnly, authHandler.LogoutAll)
+		auth.POST("/2fa/setup", requireAuth, userOnly, authHandler.SetupTwoFactor)
+		auth.POST("/2fa/verify", requireAuth, userOnly, authHandler.VerifyTwoFactor)
+		auth.POST("/2fa/login", authHandler.TwoFactorLogin)
+		auth.POST("/password/forgot", authHandler.ForgotPassword)
+		auth.POST("/password/reset", authHandler.ResetPassword)
+		auth.POST("/email/verify", authHandler.VerifyEmail)
+		auth.POST("/email/resend", requireAuth, userOnly, authHandler.ResendVerification)
 	}
 
+	// OAuth2 token endpoint for third-party apps
+	r.POST("/oauth/token", authHandler.OAuthToken)
+
 	// Protected routes
 	api := r.Group("/api/v1")
-	api.Use(middleware.AuthMiddleware(authService))
+	api.Use(requireAuth)
 	{
 		// Transaction routes
+		idempotent := middleware.Idempotency(idempotencyService)
+		canMove := middleware.RequirePermission(models.PermMoneyMove)
+		canRead := middleware.RequirePermission(models.PermMoneyRead)
+		canReverse := middleware.RequirePermission(models.PermTransactionsReverse)
+		stepUp := middleware.RequireStepUp(authService, accountService, fxService, stepUpAmount, cfg.DefaultCurrency)
+		verified := middleware.RequireVerifiedEmail(authService)
+		scope := middleware.RequireScope
+
 		transactions := api.Group("/transactions")
 		{
-			transactions.POST("/credit", transactionHandler.Credit)
-			transactions.POST("/debit", transactionHandler.Debit)
-			transactions.POST("/transfer", transactionHandler.Transfer)
-			transactions.GET("/history", transactionHandler.GetHistory)
-			transactions.GET("/:id", transactionHandler.GetTransaction)
+			transactions.POST("/credit", scope(models.ScopeTransactionsWrite), canMove, verified, idempotent, transactionHandler.Credit)
+			transactions.POST("/debit", scope(models.ScopeTransactionsWrite), canMove, verified, idempotent, transactionHandler.Debit)
+			transactions.POST("/transfer", scope(models.ScopeTransactionsWrite), canMove, verified, stepUp, idempotent, transactionHandler.Transfer)
+			transactions.GET("/history", scope(models.ScopeTransactionsRead), canRead, transactionHandler.GetHistory)
+			transactions.POST("/holds", scope(models.ScopeTransactionsWrite), canMove, verified, idempotent, transactionHandler.CreateHold)
+			transactions.GET("/holds", scope(models.ScopeTransactionsRead), canRead, transactionHandler.GetActiveHolds)
+			transactions.GET("/holds/:id", scope(models.ScopeTransactionsRead), canRead, transactionHandler.GetHold)
+			transactions.POST("/holds/:id/capture", scope(models.ScopeTransactionsWrite), canMove, verified, idempotent, transactionHandler.CaptureHold)
+			transactions.POST("/holds/:id/release", scope(models.ScopeTransactionsWrite), canMove, verified, idempotent, transactionHandler.ReleaseHold)
+			transactions.GET("/:id", scope(models.ScopeTransactionsRead), canRead, transactionHandler.GetTransaction)
+			transactions.POST("/:id/reverse", userOnly, canReverse, verified, idempotent, transactionHandler.Reverse)
+			transactions.POST("/:id/refund", userOnly, canReverse, verified, idempotent, transactionHandler.Refund)
+		}
+
+		// Account routes
+		accounts := api.Group("/accounts")
+		{
+			canManage := middleware.RequirePermission(models.PermAccountsManage)
+
+			accounts.POST("", scope(models.ScopeAccountsWrite), canManage, accountHandler.CreateAccount)
+			accounts.GET("", scope(models.ScopeAccountsRead), canRead, accountHandler.GetAccounts)
+			accounts.GET("/:id", scope(models.ScopeAccountsRead), canRead, accountHandler.GetAccount)
+			accounts.PUT("/:id", scope(models.ScopeAccountsWrite), canManage, accountHandler.UpdateAccount)
+			accounts.DELETE("/:id", scope(models.ScopeAccountsWrite), canManage, accountHandler.CloseAccount)
+			accounts.PUT("/:id/status", userOnly, middleware.RequirePermission(models.PermAccountsFreeze), accountHandler.SetAccountStatus)
 		}
 
 		// Balance routes
 		balances := api.Group("/balances")
+		balances.Use(scope(models.ScopeBalancesRead), canRead)
 		{
 			balances.GET("/current", balanceHandler.GetCurrentBalance)
 			balances.GET("/historical", balanceHandler.GetHistoricalBalance)
 			balances.GET("/at-time", balanceHandler.GetBalanceAtTime)
+			balances.GET("/verify", balanceHandler.VerifyBalance)
+		}
+
+		// Exchange rate routes
+		fx := api.Group("/fx")
+		{
+			fx.GET("/rates", scope(models.ScopeFXRead), middleware.RequirePermission(models.PermFXRead), fxHandler.GetRates)
+			fx.PUT("/rates", middleware.RequirePermission(models.PermFXManage), fxHandler.SetRates)
+		}
+
+		// Session routes
+		sessions := api.Group("/sessions")
+		sessions.Use(userOnly)
+		{
+			sessions.GET("", authHandler.GetSessions)
+			sessions.DELETE("/:id", authHandler.RevokeSession)
+		}
+
+		// API key routes
+		apiKeys := api.Group("/api-keys")
+		apiKeys.Use(userOnly)
+		{
+			apiKeys.POST("", authHandler.CreateAPIKey)
+			apiKeys.GET("", authHandler.GetAPIKeys)
+			apiKeys.DELETE("/:id", authHandler.RevokeAPIKey)
 		}
 
-		// User routes
+		// OAuth routes: consent by users, client registration by admins
+		oauth := api.Group("/oauth")
+		oauth.Use(userOnly)
+		{
+			manageClients := middleware.RequirePermission(models.PermOAuthClients)
+
+			oauth.GET("/authorize", authHandler.GetAuthorization)
+			oauth.POST("/authorize", authHandler.Authorize)
+			oauth.GET("/consents", authHandler.GetOAuthConsents)
+			oauth.DELETE("/consents/:id", authHandler.RevokeOAuthConsent)
+			oauth.POST("/clients", manageClients, authHandler.RegisterOAuthClient)
+			oauth.GET("/clients", manageClients, authHandler.GetOAuthClients)
+			oauth.DELETE("/clients/:id", manageClients, authHandler.RevokeOAuthClient)
+		}
+
+		// Audit log routes for compliance staff
+		auditLogs := api.Group("/audit-logs")
+		auditLogs.Use(userOnly, middleware.RequirePermission(models.PermAuditRead))
+		{
+			auditLogs.GET("", auditHandler.GetAuditLogs)
+			auditLogs.GET("/export", auditHandler.ExportAuditLogs)
+			auditLogs.GET("/writer", auditHandler.GetWriterStats)
+		}
+
+		// User routes: everyone may read and update themselves
 		users := api.Group("/users")
 		{
-			users.GET("", authHandler.GetAllUsers)
-			users.GET("/:id", authHandler.GetUser)
-			users.PUT("/:id", authHandler.UpdateUser)
-			users.DELETE("/:id", authHandler.DeleteUser)
+			users.GET("", middleware.RequirePermission(models.PermUsersRead), authHandler.GetAllUsers)
+			users.GET("/:id", middleware.RequireSelfOrPermission(models.PermUsersRead), authHandler.GetUser)
+			users.PATCH("/:id", middleware.RequireSelfOrPermission(models.PermUsersManage), authHandler.UpdateUser)
+			users.PUT("/:id", middleware.RequireSelfOrPermission(models.PermUsersManage), authHandler.UpdateUser) // same partial semantics, kept for older clients
+			users.DELETE("/:id", middleware.RequirePermission(models.PermUsersManage), authHandler.DeleteUser)
+			users.POST("/:id/unlock", middleware.RequirePermission(models.PermUsersManage), authHandler.UnlockUser)
 		}
 	}
 
@@ -80,5 +320,46 @@ func main() {
 	})
 
 	// Start server
-	r.Run(":8080")
+	srv := &http.Server{Addr: ":" + cfg.ServerPort, Handler: r}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Server failed:", err)
+		}
+	}()
+
+	// Finish in-flight requests, then write out the audit entries they queued
+	<-ctx.Done()
+	stop()
+	log.Println("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Println("Server shutdown:", err)
+	}
+	if err := auditWriter.Close(shutdownCtx); err != nil {
+		log.Println("Audit writer did not drain:", err)
+	}
+}
+
+// Report the state of the audit chain; the exit status is 1 if it is broken
+func verifyAudit() int {
+	result, err := services.VerifyAuditChain(config.GetDB())
+	if err != nil {
+		log.Println("Failed to verify audit log:", err)
+		return 2
+	}
+	if !result.OK() {
+		fmt.Printf("Audit log is broken after %d valid entries: %s\n", result.Entries, result.Problem)
+		return 1
+	}
+	fmt.Printf("Audit log intact: %d entries, %d more archived\n", result.Entries, result.Archived)
+	entityTypes := make([]string, 0, len(result.Heads))
+	for entityType := range result.Heads {
+		entityTypes = append(entityTypes, entityType)
+	}
+	sort.Strings(entityTypes)
+	for _, entityType := range entityTypes {
+		fmt.Printf("  %s head hash %s\n", entityType, result.Heads[entityType])
+	}
+	return 0
 }
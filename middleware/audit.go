@@ -1,19 +1,45 @@
 package middleware
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
-	"bbank/models"
+	"bbank/services"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/gorm"
 )
 
-func AuditLogger(db *gorm.DB) gin.HandlerFunc {
+// Bodies larger than this are not digested
+const maxDigestedBody = 1 << 20
+
+// Body fields whose values never reach the digest; matched as substrings
+// of the lower-cased field name
+var redactedFields = []string{"password", "secret", "token", "code", "otp"}
+
+// Log every authenticated request through the audit writer
+func AuditLogger(writer *services.AuditWriter) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		start := time.Now()
 
+		var digest string
+		var digestSkipped bool
+		if isMutating(c.Request.Method) && c.Request.Body != nil {
+			body, complete := peekBody(c.Request)
+			if complete {
+				digest = bodyDigest(c.ContentType(), body)
+			} else {
+				digestSkipped = true
+			}
+		}
+
 		c.Next() // Process request
 
 		userIDVal, exists := c.Get("user_id")
@@ -31,19 +57,103 @@ func AuditLogger(db *gorm.DB) gin.HandlerFunc {
 			"path":        c.FullPath(),
 			"status_code": c.Writer.Status(),
 			"duration_ms": time.Since(start).Milliseconds(),
+			"request_id":  c.GetString("request_id"),
+			"ip_address":  c.ClientIP(),
+			"user_agent":  c.Request.UserAgent(),
+		}
+		if digest != "" {
+			details["body_digest"] = digest
+		}
+		if digestSkipped {
+			details["body_too_large"] = true
+		}
+
+		// Batched by the writer, which applies its overflow policy when busy
+		writer.Write("api_request", userID, "called", details)
+	}
+}
+
+func isMutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// Read up to maxDigestedBody bytes of the body and put them back for the
+// handler. Reports whether the whole body was read.
+func peekBody(req *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxDigestedBody+1))
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+	if err != nil || len(body) > maxDigestedBody {
+		return nil, false
+	}
+	return body, true
+}
+
+// SHA-256 of the body with secrets blanked out, so the digest identifies
+// a payload without letting anyone guess a password from it. JSON and form
+// bodies are normalized first; others are hashed as sent.
+func bodyDigest(contentType string, body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+
+	normalized := body
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/json":
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		var value interface{}
+		if err := decoder.Decode(&value); err == nil {
+			if data, err := json.Marshal(redactJSON(value)); err == nil {
+				normalized = data
+			}
+		}
+	case "application/x-www-form-urlencoded":
+		if values, err := url.ParseQuery(string(body)); err == nil {
+			for key := range values {
+				if isRedacted(key) {
+					values[key] = []string{"[REDACTED]"}
+				}
+			}
+			normalized = []byte(values.Encode())
 		}
+	}
 
-		jsonDetails, _ := json.Marshal(details)
+	sum := sha256.Sum256(normalized)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
 
-		log := models.AuditLog{
-			EntityType: "api_request",
-			EntityID:   userID,
-			Action:     "called",
-			Details:    jsonDetails,
-			CreatedAt:  time.Now(),
+func redactJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if isRedacted(key) {
+				v[key] = "[REDACTED]"
+			} else {
+				v[key] = redactJSON(field)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactJSON(v[i])
 		}
+	}
+	return value
+}
 
-		// Store asynchronously (non-blocking)
-		go db.Create(&log)
+func isRedacted(field string) bool {
+	field = strings.ToLower(field)
+	for _, name := range redactedFields {
+		if strings.Contains(field, name) {
+			return true
+		}
 	}
+	return false
 }
@@ -10,8 +10,29 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+const APIKeyHeader = "X-API-Key"
+
+// Authenticate with a bearer access token, a token delegated to an OAuth
+// client, or an API key in the X-API-Key header
 func AuthMiddleware(authService *services.AuthService) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if apiKey := c.GetHeader(APIKeyHeader); apiKey != "" {
+			claims, err := authService.AuthenticateAPIKey(apiKey, c.ClientIP())
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+				c.Abort()
+				return
+			}
+
+			c.Set("user_id", claims.UserID)
+			c.Set("role", claims.Role)
+			c.Set("api_key_id", claims.APIKeyID)
+			c.Set("api_key_ip_bound", claims.IPBound)
+			c.Set("scopes", claims.Scopes)
+			c.Next()
+			return
+		}
+
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
@@ -28,15 +49,22 @@ func AuthMiddleware(authService *services.AuthService) gin.HandlerFunc {
 		}
 
 		token := parts[1]
-		userID, err := authService.ValidateToken(token)
+		claims, err := authService.ValidateToken(token)
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 			c.Abort()
 			return
 		}
 
-		// Store user ID in context
-		c.Set("user_id", userID)
+		// Store user ID, role and session in context
+		c.Set("user_id", claims.UserID)
+		c.Set("role", claims.Role)
+		if claims.ClientID != "" {
+			c.Set("client_id", claims.ClientID)
+			c.Set("scopes", claims.Scopes)
+		} else {
+			c.Set("session_id", claims.SessionID)
+		}
 		c.Next()
 	}
 }
@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"bbank/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// Captures the response body so it can be stored for replays
+type bodyRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *bodyRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *bodyRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Idempotency replays the stored response for a repeated Idempotency-Key
+// instead of running the handler again. Must be used after AuthMiddleware.
+func Idempotency(idempotencyService *services.IdempotencyService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyKeyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > 255 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key must be at most 255 characters"})
+			c.Abort()
+			return
+		}
+
+		userIDVal, _ := c.Get("user_id")
+		userID, ok := userIDVal.(uint)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "authentication required"})
+			c.Abort()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read request body"})
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.New()
+		// The concrete path, so a key reused on another hold or transaction
+		// ID is a mismatch rather than a replay
+		hash.Write([]byte(c.Request.Method + " " + c.Request.URL.Path + "?" + c.Request.URL.RawQuery + "\n"))
+		hash.Write(body)
+		requestHash := hex.EncodeToString(hash.Sum(nil))
+
+		record, replay, err := idempotencyService.Begin(userID, key, requestHash)
+		switch {
+		case errors.Is(err, services.ErrIdempotencyKeyMismatch):
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			c.Abort()
+			return
+		case errors.Is(err, services.ErrIdempotencyKeyInProgress):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			c.Abort()
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.Abort()
+			return
+		}
+
+		if replay {
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(record.StatusCode, "application/json; charset=utf-8", record.Response)
+			c.Abort()
+			return
+		}
+
+		release := func() {
+			if err := idempotencyService.Abort(record); err != nil {
+				log.Printf("failed to release idempotency key %q: %v", key, err)
+			}
+		}
+		// Recovery runs outside this middleware, so release the key before
+		// passing a handler panic on
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				release()
+				panic(recovered)
+			}
+		}()
+
+		recorder := &bodyRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+
+		c.Next()
+
+		// Server errors are not stored so the client can retry them
+		status := c.Writer.Status()
+		if status >= http.StatusInternalServerError {
+			release()
+			return
+		}
+
+		response := recorder.body.Bytes()
+		if !json.Valid(response) {
+			response = []byte("null")
+		}
+		// On failure the key stays reserved until its lease runs out, which
+		// delays retries rather than risking a second execution right away
+		if err := idempotencyService.Complete(record, status, response); err != nil {
+			log.Printf("failed to store idempotent response for key %q: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"bbank/models"
+	"bbank/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+const OTPCodeHeader = "X-OTP-Code"
+
+// RequireStepUp asks for a fresh second factor in the X-OTP-Code header
+// when the transfer amount, valued in the threshold's currency, exceeds it.
+// Amounts that can not be valued for lack of a rate need the code too. A
+// zero threshold disables the check. Must run after AuthMiddleware and
+// before Idempotency, so a rejected code does not use up the idempotency key.
+func RequireStepUp(authService *services.AuthService, accountService *services.AccountService, fxService *services.FXService, threshold models.Money, currency string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// An IP allow-list stands in for the second factor of an API key;
+		// keys usable from anywhere need the owner's code like a session
+		if threshold <= 0 || (c.GetUint("api_key_id") != 0 && c.GetBool("api_key_ip_bound")) {
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read request body"})
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		// Malformed bodies are left to the handler to reject
+		var req struct {
+			Amount        models.Money `json:"amount"`
+			FromAccountID *uint        `json:"from_account_id"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			c.Next()
+			return
+		}
+		account, err := accountService.ResolveAccount(c.GetUint("user_id"), req.FromAccountID)
+		if err != nil {
+			c.Next()
+			return
+		}
+		if value, err := fxService.Value(account.Currency, currency, req.Amount); err == nil && value <= threshold {
+			c.Next()
+			return
+		}
+
+		client := services.ClientInfo{IPAddress: c.ClientIP(), UserAgent: c.Request.UserAgent()}
+		err = authService.StepUp(c.GetUint("user_id"), c.GetHeader(OTPCodeHeader), client)
+		var blocked *services.LoginBlockedError
+		switch {
+		case errors.As(err, &blocked):
+			retryAfter := int(math.Ceil(time.Until(blocked.Until).Seconds()))
+			c.Header("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error(), "step_up_required": true})
+			c.Abort()
+			return
+		case errors.Is(err, services.ErrTwoFactorNotEnabled):
+			c.JSON(http.StatusForbidden, gin.H{"error": "two-factor authentication must be enabled for amounts above " + threshold.String() + " " + currency})
+			c.Abort()
+			return
+		case err != nil:
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error(), "step_up_required": true})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+
+	"bbank/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Allow the request only for users who confirmed their email address. Must
+// run after AuthMiddleware.
+func RequireVerifiedEmail(authService *services.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := authService.CheckEmailVerified(c.GetUint("user_id"))
+		switch {
+		case errors.Is(err, services.ErrEmailNotVerified):
+			c.JSON(http.StatusForbidden, gin.H{"error": "Please verify your email address first"})
+			c.Abort()
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
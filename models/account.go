@@ -0,0 +1,49 @@
+package models
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// Account types
+const (
+	AccountTypeChecking = "checking"
+	AccountTypeSavings  = "savings"
+)
+
+// Account statuses
+const (
+	AccountStatusActive = "active"
+	AccountStatusFrozen = "frozen"
+	AccountStatusClosed = "closed"
+)
+
+type Account struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	UserID    uint      `json:"user_id" gorm:"not null;index;uniqueIndex:idx_accounts_user_default,where:is_default"`
+	Number    string    `json:"number" gorm:"not null;uniqueIndex"` // IBAN-like, see AccountNumber
+	Name      string    `json:"name"`
+	Type      string    `json:"type" gorm:"not null;default:checking"`
+	Currency  string    `json:"currency" gorm:"size:3;not null"`
+	Status    string    `json:"status" gorm:"not null;default:active"`
+	IsDefault bool      `json:"is_default" gorm:"not null;default:false"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// Relationships
+	User    User     `json:"-" gorm:"foreignKey:UserID"`
+	Balance *Balance `json:"balance,omitempty" gorm:"foreignKey:AccountID"`
+}
+
+// AccountNumber builds an IBAN-like number ("BB" + two ISO 7064 mod 97-10
+// check digits + 16-digit account ID) for the given account ID.
+func AccountNumber(id uint) string {
+	bban := fmt.Sprintf("%016d", id)
+
+	// Country code letters map to two digits each: B = 11
+	numeric, _ := new(big.Int).SetString(bban+"111100", 10)
+	check := 98 - new(big.Int).Mod(numeric, big.NewInt(97)).Int64()
+
+	return fmt.Sprintf("BB%02d%s", check, bban)
+}
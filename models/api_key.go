@@ -0,0 +1,61 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/datatypes"
+)
+
+// API key scopes
+const (
+	ScopeTransactionsRead  = "transactions:read"
+	ScopeTransactionsWrite = "transactions:write"
+	ScopeBalancesRead      = "balances:read"
+	ScopeAccountsRead      = "accounts:read"
+	ScopeAccountsWrite     = "accounts:write"
+	ScopeFXRead            = "fx:read"
+)
+
+var apiKeyScopes = []string{
+	ScopeTransactionsRead,
+	ScopeTransactionsWrite,
+	ScopeBalancesRead,
+	ScopeAccountsRead,
+	ScopeAccountsWrite,
+	ScopeFXRead,
+}
+
+func IsValidScope(scope string) bool {
+	for _, s := range apiKeyScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Key for machine access on behalf of its owner. The key is shown once;
+// only the prefix and a hash of the whole key are stored.
+type APIKey struct {
+	ID         uint                        `json:"id" gorm:"primaryKey"`
+	UserID     uint                        `json:"user_id" gorm:"not null;index"`
+	Name       string                      `json:"name" gorm:"not null"`
+	Prefix     string                      `json:"prefix" gorm:"size:16;not null;uniqueIndex"`
+	KeyHash    string                      `json:"-" gorm:"size:64;not null"`
+	Scopes     datatypes.JSONSlice[string] `json:"scopes" gorm:"type:jsonb;not null"`
+	AllowedIPs datatypes.JSONSlice[string] `json:"allowed_ips" gorm:"type:jsonb"` // IPs or CIDRs, empty allows any
+	ExpiresAt  *time.Time                  `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time                  `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time                  `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time                   `json:"created_at"`
+}
+
+// Report whether the key grants scope
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
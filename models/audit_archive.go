@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// An audit log partition that was written to a gzipped NDJSON file in the
+// archive directory and then dropped
+type AuditArchive struct {
+	ID         uint                  `json:"id" gorm:"primaryKey"`
+	Partition  string                `json:"partition" gorm:"index;not null"` // archived again if late entries restored its month
+	File       string                `json:"file" gorm:"not null"`            // relative to the archive directory
+	SHA256     string                `json:"sha256" gorm:"size:64;not null"`
+	Entries    int64                 `json:"entries"`
+	RangeStart time.Time             `json:"range_start"`
+	RangeEnd   time.Time             `json:"range_end"`
+	Segments   []AuditArchiveSegment `json:"segments"`
+	CreatedAt  time.Time             `json:"created_at"`
+}
+
+// A run of consecutive entries of one entity type's chain inside an archive.
+// Verification skips from FirstPrevHash to LastHash over it.
+type AuditArchiveSegment struct {
+	ID             uint   `json:"-" gorm:"primaryKey"`
+	AuditArchiveID uint   `json:"-" gorm:"not null;index"`
+	EntityType     string `json:"entity_type" gorm:"not null;index:idx_audit_archive_segments_type_last,priority:1"`
+	FirstID        uint   `json:"first_id"`
+	LastID         uint   `json:"last_id" gorm:"index:idx_audit_archive_segments_type_last,priority:2"`
+	Entries        int64  `json:"entries"`
+	FirstPrevHash  string `json:"first_prev_hash" gorm:"size:64;not null"`
+	LastHash       string `json:"last_hash" gorm:"size:64;not null"`
+}
@@ -1,16 +1,72 @@
 package models
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"time"
 
 	"gorm.io/datatypes"
 )
 
+// Hash of the row before the first one in each chain
+const AuditGenesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// Audit entries of each entity type form a hash chain in ID order: each row
+// stores the hash of the previous row of its type and a hash over its own
+// content, so editing or deleting a row breaks every later link. Separate
+// chains let a type's old entries be archived without touching the others.
+//
+// The table is partitioned by month of CreatedAt and then by EntityType;
+// its primary key is (id, created_at).
 type AuditLog struct {
-	ID         uint           `gorm:"primaryKey"`
-	EntityType string         `gorm:"not null"` // e.g. "user", "transaction", "api_request"
-	EntityID   uint           `gorm:"not null"` // user_id
-	Action     string         `gorm:"not null"` // e.g. "updated", "created", "called"
-	Details    datatypes.JSON `gorm:"type:jsonb"`
-	CreatedAt  time.Time
+	ID         uint           `json:"id" gorm:"primaryKey;index:idx_audit_logs_type_id,priority:2"`
+	EntityType string         `json:"entity_type" gorm:"not null;index:idx_audit_logs_type_id,priority:1"` // e.g. "user", "transaction", "api_request"
+	EntityID   uint           `json:"entity_id" gorm:"not null"`                                           // user_id
+	Action     string         `json:"action" gorm:"not null"`                                              // e.g. "updated", "created", "called"
+	Details    datatypes.JSON `json:"details" gorm:"type:jsonb"`
+	CreatedAt  time.Time      `json:"created_at" gorm:"not null;index"`
+	PrevHash   string         `json:"prev_hash" gorm:"size:64"`
+	Hash       string         `json:"hash" gorm:"size:64;index"`
+}
+
+// Compute the hash of the entry chained to prevHash. Details are hashed in
+// canonical form so that the jsonb round trip does not change the result.
+func (a *AuditLog) ChainHash(prevHash string) (string, error) {
+	details, err := CanonicalJSON(a.Details)
+	if err != nil {
+		return "", err
+	}
+
+	content, err := json.Marshal([]interface{}{
+		prevHash,
+		a.EntityType,
+		a.EntityID,
+		a.Action,
+		json.RawMessage(details),
+		a.CreatedAt.UTC().Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Re-encode JSON with sorted object keys, no insignificant whitespace and
+// numbers kept as written. Empty input encodes as null.
+func CanonicalJSON(data []byte) ([]byte, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return []byte("null"), nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
 }
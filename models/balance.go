@@ -5,8 +5,17 @@ import (
 )
 
 type Balance struct {
-	UserID        uint      `json:"user_id" gorm:"primaryKey"`
-	Amount        float64   `json:"amount" gorm:"default:0"`
+	AccountID     uint      `json:"account_id" gorm:"primaryKey;autoIncrement:false"`
+	UserID        uint      `json:"user_id" gorm:"not null;index"`
+	Amount        Money     `json:"amount" gorm:"type:bigint;not null;default:0"`
+	Currency      string    `json:"currency" gorm:"size:3"`                            // same as the account
+	HeldAmount    Money     `json:"held_amount" gorm:"type:bigint;not null;default:0"` // reserved by active holds
+	Version       uint      `json:"version" gorm:"not null;default:0"`                 // optimistic concurrency counter
 	LastUpdatedAt time.Time `json:"last_updated_at"`
 	User          User      `json:"user" gorm:"foreignKey:UserID"`
 }
+
+// Funds that can be spent: ledger amount minus active holds
+func (b Balance) Available() Money {
+	return b.Amount - b.HeldAmount
+}
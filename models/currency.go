@@ -0,0 +1,35 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// ISO 4217 currencies the bank holds. Money assumes two minor digits, so
+// only currencies with an exponent of 2 can be listed here.
+var supportedCurrencies = map[string]bool{
+	"EUR": true,
+	"USD": true,
+	"TRY": true,
+	"GBP": true,
+	"CHF": true,
+}
+
+func IsSupportedCurrency(code string) bool {
+	return supportedCurrencies[code]
+}
+
+// Normalize user input such as "eur" to "EUR"
+func NormalizeCurrency(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// ExchangeRate says that one unit of BaseCurrency buys Rate units of
+// QuoteCurrency (mid-market, before spread)
+type ExchangeRate struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	BaseCurrency  string    `json:"base_currency" gorm:"size:3;not null;uniqueIndex:idx_exchange_rates_pair"`
+	QuoteCurrency string    `json:"quote_currency" gorm:"size:3;not null;uniqueIndex:idx_exchange_rates_pair"`
+	Rate          string    `json:"rate" gorm:"type:numeric(20,10);not null"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
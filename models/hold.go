@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+)
+
+// Hold statuses
+const (
+	HoldStatusActive   = "active"
+	HoldStatusCaptured = "captured"
+	HoldStatusReleased = "released"
+	HoldStatusExpired  = "expired"
+)
+
+// Hold reserves funds on a balance until it is captured, released or expires
+type Hold struct {
+	ID             uint      `json:"id" gorm:"primaryKey"`
+	UserID         uint      `json:"user_id" gorm:"not null;index"`
+	AccountID      uint      `json:"account_id" gorm:"index"`
+	Amount         Money     `json:"amount" gorm:"type:bigint;not null"`
+	Currency       string    `json:"currency" gorm:"size:3"`
+	CapturedAmount Money     `json:"captured_amount" gorm:"type:bigint;not null;default:0"`
+	Status         string    `json:"status" gorm:"not null;default:active;index"`
+	Description    string    `json:"description"`
+	ExpiresAt      time.Time `json:"expires_at" gorm:"not null;index"`
+	TransactionID  *uint     `json:"transaction_id,omitempty"` // debit created on capture
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
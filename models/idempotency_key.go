@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/datatypes"
+)
+
+// Stored outcome of a request made with an Idempotency-Key header
+type IdempotencyKey struct {
+	ID          uint           `gorm:"primaryKey"`
+	UserID      uint           `gorm:"not null;uniqueIndex:idx_idempotency_user_key"`
+	Key         string         `gorm:"not null;size:255;uniqueIndex:idx_idempotency_user_key"`
+	RequestHash string         `gorm:"not null"` // sha256 of method, route and body
+	StatusCode  int            // 0 while the original request is still running
+	Response    datatypes.JSON `gorm:"type:jsonb"`
+	CreatedAt   time.Time
+	CompletedAt *time.Time
+	ExpiresAt   time.Time `gorm:"not null;index"` // end of the reservation lease, then of the replay window
+}
@@ -0,0 +1,38 @@
+package models
+
+import (
+	"time"
+)
+
+// System ledger accounts that offset money entering or leaving the bank
+const (
+	SystemAccountCashIn         = "cash_in"
+	SystemAccountCashOut        = "cash_out"
+	SystemAccountOpeningBalance = "opening_balance"
+	SystemAccountFXPosition     = "fx_position" // bank side of currency conversions
+)
+
+// JournalEntry groups the postings of one business event. The postings of
+// an entry always sum to zero per currency.
+type JournalEntry struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	TransactionID *uint     `json:"transaction_id,omitempty" gorm:"index"`
+	Description   string    `json:"description"`
+	CreatedAt     time.Time `json:"created_at"`
+
+	// Relationships
+	Postings []Posting `json:"postings" gorm:"foreignKey:JournalEntryID"`
+}
+
+// Posting is one leg of a journal entry. A positive amount increases the
+// account balance and a negative amount decreases it.
+type Posting struct {
+	ID             uint      `json:"id" gorm:"primaryKey"`
+	JournalEntryID uint      `json:"journal_entry_id" gorm:"not null;index"`
+	AccountID      *uint     `json:"account_id,omitempty" gorm:"index"` // nil for system accounts
+	UserID         *uint     `json:"user_id,omitempty" gorm:"index"`    // owner of AccountID
+	SystemAccount  string    `json:"system_account,omitempty" gorm:"index"`
+	Amount         Money     `json:"amount" gorm:"type:bigint;not null"`
+	Currency       string    `json:"currency" gorm:"size:3"`
+	CreatedAt      time.Time `json:"created_at" gorm:"index"`
+}
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// Login throttle scopes
+const (
+	LoginScopeAccount = "account" // keyed by normalized email
+	LoginScopeIP      = "ip"
+)
+
+// Recent failed logins for one account or one client IP
+type LoginThrottle struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	Scope         string     `json:"scope" gorm:"size:16;not null;uniqueIndex:idx_login_throttles_scope_key"`
+	Key           string     `json:"key" gorm:"not null;uniqueIndex:idx_login_throttles_scope_key"`
+	Failures      int        `json:"failures" gorm:"not null;default:0"`
+	LastFailureAt time.Time  `json:"last_failure_at" gorm:"index"` // last counted attempt
+	LockedUntil   *time.Time `json:"locked_until,omitempty"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
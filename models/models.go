@@ -4,8 +4,26 @@ package models
 func GetAllModels() []interface{} {
 	return []interface{}{
 		&User{},
+		&Session{},
+		&RefreshToken{},
+		&RecoveryCode{},
+		&PasswordHistory{},
+		&LoginThrottle{},
+		&UserToken{},
+		&APIKey{},
+		&OAuthClient{},
+		&OAuthAuthorizationCode{},
+		&OAuthConsent{},
+		&Account{},
 		&Balance{},
 		&Transaction{},
+		&JournalEntry{},
+		&Posting{},
+		&Hold{},
+		&ExchangeRate{},
 		&AuditLog{},
+		&AuditArchive{},
+		&AuditArchiveSegment{},
+		&IdempotencyKey{},
 	}
 }
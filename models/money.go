@@ -0,0 +1,129 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Money is an exact monetary amount stored in minor units (e.g. cents).
+// It is persisted as BIGINT and serialized as a decimal string in JSON
+// ("12.34") so clients never lose precision.
+type Money int64
+
+// Number of minor units in one major unit
+const MinorUnitsPerMajor = 100
+
+// Largest amount ParseMoney accepts, one trillion major units. Requests
+// stay far below the int64 range, so sums of them can be checked cheaply.
+const MaxMoney Money = 1_000_000_000_000 * MinorUnitsPerMajor
+
+var (
+	ErrInvalidMoney  = errors.New("invalid money amount")
+	ErrMoneyOverflow = errors.New("amount is out of range")
+)
+
+// Parse a decimal string such as "12.34", "-0.5" or "100" into Money
+func ParseMoney(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, ErrInvalidMoney
+	}
+
+	negative := false
+	switch s[0] {
+	case '-':
+		negative = true
+		s = s[1:]
+	case '+':
+		s = s[1:]
+	}
+
+	whole, frac, hasFrac := strings.Cut(s, ".")
+	if whole == "" && frac == "" {
+		return 0, ErrInvalidMoney
+	}
+	if hasFrac && (frac == "" || len(frac) > 2) {
+		return 0, fmt.Errorf("%w: at most 2 decimal places allowed", ErrInvalidMoney)
+	}
+	if whole == "" {
+		whole = "0"
+	}
+	for len(frac) < 2 {
+		frac += "0"
+	}
+
+	for _, r := range whole + frac {
+		if r < '0' || r > '9' {
+			return 0, ErrInvalidMoney
+		}
+	}
+
+	units, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || units > int64(MaxMoney/MinorUnitsPerMajor) {
+		return 0, fmt.Errorf("%w: out of range", ErrInvalidMoney)
+	}
+	cents, _ := strconv.ParseInt(frac, 10, 64)
+
+	amount := Money(units*MinorUnitsPerMajor + cents)
+	if amount > MaxMoney {
+		return 0, fmt.Errorf("%w: out of range", ErrInvalidMoney)
+	}
+	if negative {
+		amount = -amount
+	}
+	return amount, nil
+}
+
+// Add returns m + n, or ErrMoneyOverflow if the sum does not fit in Money
+func (m Money) Add(n Money) (Money, error) {
+	sum := m + n
+	if (n > 0 && sum < m) || (n < 0 && sum > m) {
+		return 0, ErrMoneyOverflow
+	}
+	return sum, nil
+}
+
+// Sub returns m - n, or ErrMoneyOverflow if the difference does not fit
+func (m Money) Sub(n Money) (Money, error) {
+	diff := m - n
+	if (n > 0 && diff > m) || (n < 0 && diff < m) {
+		return 0, ErrMoneyOverflow
+	}
+	return diff, nil
+}
+
+// String formats the amount as a decimal string with two fraction digits
+func (m Money) String() string {
+	sign := ""
+	v := int64(m)
+	if v < 0 {
+		sign = "-"
+		v = -v
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, v/MinorUnitsPerMajor, v%MinorUnitsPerMajor)
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(m.String())), nil
+}
+
+// UnmarshalJSON accepts both "12.34" and 12.34; numbers are parsed from
+// their literal text, never through float64.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+
+	parsed, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
@@ -0,0 +1,55 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/datatypes"
+)
+
+// Scopes third-party apps may ask for. Tokens issued to a user through the
+// authorization code flow are limited to reading balances and history;
+// client credentials tokens act for no user and only read public data.
+var (
+	OAuthUserScopes   = []string{ScopeBalancesRead, ScopeTransactionsRead}
+	OAuthClientScopes = []string{ScopeFXRead}
+)
+
+// A registered third-party application
+type OAuthClient struct {
+	ID           uint                        `json:"id" gorm:"primaryKey"`
+	ClientID     string                      `json:"client_id" gorm:"size:64;not null;uniqueIndex"`
+	SecretHash   string                      `json:"-" gorm:"size:64"` // empty for public clients
+	Name         string                      `json:"name" gorm:"not null"`
+	Confidential bool                        `json:"confidential" gorm:"not null;default:false"`
+	RedirectURIs datatypes.JSONSlice[string] `json:"redirect_uris" gorm:"type:jsonb;not null"`
+	Scopes       datatypes.JSONSlice[string] `json:"scopes" gorm:"type:jsonb;not null"` // the most the client may get
+	CreatedBy    uint                        `json:"created_by"`
+	RevokedAt    *time.Time                  `json:"revoked_at,omitempty"`
+	CreatedAt    time.Time                   `json:"created_at"`
+}
+
+// Short-lived code handed to the client after the user approved it
+type OAuthAuthorizationCode struct {
+	ID            uint                        `gorm:"primaryKey"`
+	CodeHash      string                      `gorm:"size:64;not null;uniqueIndex"`
+	ClientID      string                      `gorm:"size:64;not null"`
+	UserID        uint                        `gorm:"not null"`
+	RedirectURI   string                      `gorm:"not null"`
+	Scopes        datatypes.JSONSlice[string] `gorm:"type:jsonb;not null"`
+	CodeChallenge string                      `gorm:"not null"` // PKCE S256
+	ExpiresAt     time.Time                   `gorm:"not null"`
+	UsedAt        *time.Time
+	CreatedAt     time.Time
+}
+
+// A user's approval of a client for a set of scopes
+type OAuthConsent struct {
+	ID        uint                        `json:"id" gorm:"primaryKey"`
+	UserID    uint                        `json:"user_id" gorm:"not null;uniqueIndex:idx_oauth_consents_user_client"`
+	ClientID  string                      `json:"client_id" gorm:"size:64;not null;uniqueIndex:idx_oauth_consents_user_client"`
+	Scopes    datatypes.JSONSlice[string] `json:"scopes" gorm:"type:jsonb;not null"`
+	RevokedAt *time.Time                  `json:"revoked_at,omitempty"`
+	CreatedAt time.Time                   `json:"created_at"`
+	UpdatedAt time.Time                   `json:"updated_at"`
+	Client    *OAuthClient                `json:"client,omitempty" gorm:"foreignKey:ClientID;references:ClientID"`
+}
@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+// Hash of a password the user had, kept to prevent reuse
+type PasswordHistory struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"not null;index"`
+	Hash      string    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"index"`
+}
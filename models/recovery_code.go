@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// Single-use code that replaces a TOTP code when the device is lost
+type RecoveryCode struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"not null;index"`
+	CodeHash  string `gorm:"size:64;not null"` // hex sha256 of the normalized code
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// A refresh token issued to a user. Tokens issued by rotating one another
+// share a FamilyID; only a hash of the token itself is stored.
+type RefreshToken struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	UserID    uint       `json:"user_id" gorm:"not null;index"`
+	JTI       string     `json:"-" gorm:"size:36;not null;uniqueIndex"`
+	FamilyID  string     `json:"family_id" gorm:"size:36;not null;index"`
+	TokenHash string     `json:"-" gorm:"size:64;not null"` // hex sha256 of the signed token
+	ExpiresAt time.Time  `json:"expires_at" gorm:"not null"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`    // set when rotated
+	RevokedAt *time.Time `json:"revoked_at,omitempty"` // set on logout or reuse
+	CreatedAt time.Time  `json:"created_at"`
+}
@@ -0,0 +1,71 @@
+package models
+
+// User roles
+const (
+	RoleUser    = "user"
+	RoleSupport = "support"
+	RoleAdmin   = "admin"
+)
+
+// Permissions checked by the RBAC middleware
+const (
+	PermMoneyMove           = "money:move"           // credit, debit, transfer, holds
+	PermMoneyRead           = "money:read"           // own transactions, holds and balances
+	PermAccountsManage      = "accounts:manage"      // open, update and close own accounts
+	PermAccountsFreeze      = "accounts:freeze"      // freeze and unfreeze any account
+	PermTransactionsReverse = "transactions:reverse" // reverse or refund any customer's transaction
+	PermFXRead              = "fx:read"
+	PermFXManage            = "fx:manage"
+	PermUsersRead           = "users:read"    // list and read any user
+	PermUsersManage         = "users:manage"  // update or delete any user
+	PermOAuthClients        = "oauth:clients" // register and revoke third-party apps
+	PermAuditRead           = "audit:read"    // query and export the audit log
+)
+
+var rolePermissions = map[string][]string{
+	RoleUser: {
+		PermMoneyMove,
+		PermMoneyRead,
+		PermAccountsManage,
+		PermFXRead,
+	},
+	RoleSupport: {
+		PermMoneyRead,
+		PermAccountsFreeze,
+		PermTransactionsReverse,
+		PermFXRead,
+		PermUsersRead,
+	},
+	RoleAdmin: {
+		PermMoneyMove,
+		PermMoneyRead,
+		PermAccountsManage,
+		PermAccountsFreeze,
+		PermTransactionsReverse,
+		PermFXRead,
+		PermFXManage,
+		PermUsersRead,
+		PermUsersManage,
+		PermOAuthClients,
+		PermAuditRead,
+	},
+}
+
+func IsValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// Report whether role grants permission. Users stored without a role are
+// treated as plain users.
+func HasPermission(role, permission string) bool {
+	if role == "" {
+		role = RoleUser
+	}
+	for _, p := range rolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// A login of a user on one device. The ID doubles as the family ID of the
+// refresh tokens issued to it and as the sid claim of its access tokens.
+type Session struct {
+	ID         string     `json:"id" gorm:"primaryKey;size:36"`
+	UserID     uint       `json:"user_id" gorm:"not null;index"`
+	IPAddress  string     `json:"ip_address"`
+	UserAgent  string     `json:"user_agent"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `json:"expires_at" gorm:"not null"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
@@ -6,18 +6,55 @@ import (
 	"gorm.io/gorm"
 )
 
+// Transaction types
+const (
+	TransactionTypeCredit   = "credit"
+	TransactionTypeDebit    = "debit"
+	TransactionTypeTransfer = "transfer"
+	TransactionTypeReversal = "reversal"
+	TransactionTypeRefund   = "refund"
+)
+
+// Transaction statuses
+const (
+	TransactionStatusPending           = "pending"
+	TransactionStatusCompleted         = "completed"
+	TransactionStatusReversed          = "reversed"
+	TransactionStatusRefunded          = "refunded"
+	TransactionStatusPartiallyRefunded = "partially_refunded"
+)
+
 type Transaction struct {
-	ID         uint           `json:"id" gorm:"primaryKey"`
-	FromUserID *uint          `json:"from_user_id"` // pointer for nullable
-	ToUserID   uint           `json:"to_user_id" gorm:"not null"`
-	Amount     float64        `json:"amount" gorm:"not null"`
-	Type       string         `json:"type" gorm:"not null"` // credit, debit, transfer
-	Status     string         `json:"status" gorm:"default:pending"`
-	CreatedAt  time.Time      `json:"created_at"`
-	UpdatedAt  time.Time      `json:"updated_at"`
-	DeletedAt  gorm.DeletedAt `json:"-" gorm:"index"`
+	ID uint `json:"id" gorm:"primaryKey"`
+	// Credits have no sender and debits no recipient; the cash side is a
+	// system account in the ledger
+	FromUserID    *uint  `json:"from_user_id"` // pointer for nullable
+	ToUserID      *uint  `json:"to_user_id"`
+	FromAccountID *uint  `json:"from_account_id,omitempty" gorm:"index"`
+	ToAccountID   *uint  `json:"to_account_id,omitempty" gorm:"index"`
+	Amount        Money  `json:"amount" gorm:"type:bigint;not null"`
+	Currency      string `json:"currency" gorm:"size:3"` // currency of Amount (sender side)
+	Type          string `json:"type" gorm:"not null"`   // credit, debit, transfer, reversal, refund
+	Status        string `json:"status" gorm:"default:pending"`
+
+	// Set when the recipient account holds a different currency
+	ConvertedAmount   *Money  `json:"converted_amount,omitempty" gorm:"type:bigint"`
+	ConvertedCurrency string  `json:"converted_currency,omitempty" gorm:"size:3"`
+	FXRate            *string `json:"fx_rate,omitempty" gorm:"type:numeric(20,10)"` // mid-market rate
+	FXSpread          *string `json:"fx_spread,omitempty" gorm:"type:numeric(10,6)"`
+
+	// Reversals and refunds point at the transaction they compensate
+	OriginalTransactionID *uint `json:"original_transaction_id,omitempty" gorm:"index"`
+	RefundedAmount        Money `json:"refunded_amount" gorm:"type:bigint;not null;default:0"`
+
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
 
 	// Relationships
 	FromUser *User `json:"from_user,omitempty" gorm:"foreignKey:FromUserID"`
-	ToUser   User  `json:"to_user" gorm:"foreignKey:ToUserID"`
+	ToUser   *User `json:"to_user,omitempty" gorm:"foreignKey:ToUserID"`
+
+	OriginalTransaction *Transaction  `json:"original_transaction,omitempty" gorm:"foreignKey:OriginalTransactionID"`
+	Refunds             []Transaction `json:"refunds,omitempty" gorm:"foreignKey:OriginalTransactionID"`
 }
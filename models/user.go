@@ -7,12 +7,16 @@ import (
 )
 
 type User struct {
-	ID        uint           `json:"id" gorm:"primaryKey"`
-	Username  string         `json:"username" gorm:"uniqueIndex;not null"`
-	Email     string         `json:"email" gorm:"uniqueIndex;not null"`
-	Password  string         `json:"-" gorm:"not null"` // "-" hides from JSON
-	Role      string         `json:"role" gorm:"default:user"`
-	CreatedAt time.Time      `json:"created_at"`
-	UpdatedAt time.Time      `json:"updated_at"`
-	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
+	ID              uint           `json:"id" gorm:"primaryKey"`
+	Username        string         `json:"username" gorm:"uniqueIndex;not null"`
+	Email           string         `json:"email" gorm:"uniqueIndex;not null"`
+	Password        string         `json:"-" gorm:"not null"` // "-" hides from JSON
+	Role            string         `json:"role" gorm:"default:user"`
+	TOTPSecret      string         `json:"-"`                                                // base32, set on 2FA setup
+	TOTPEnabled     bool           `json:"two_factor_enabled" gorm:"not null;default:false"` // set once a first code is verified
+	TOTPLastStep    int64          `json:"-"`                                                // last accepted time step, blocks code replay
+	EmailVerifiedAt *time.Time     `json:"email_verified_at"`
+	CreatedAt       time.Time      `json:"created_at"`
+	UpdatedAt       time.Time      `json:"updated_at"`
+	DeletedAt       gorm.DeletedAt `json:"-" gorm:"index"`
 }
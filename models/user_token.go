@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// Purposes of user tokens
+const (
+	TokenPurposePasswordReset     = "password_reset"
+	TokenPurposeEmailVerification = "email_verification"
+	TokenPurposeTwoFactorLogin    = "2fa_challenge" // ID of a login challenge, not mailed
+)
+
+// Single-use token mailed to a user, or the ID of a 2FA login challenge;
+// only its hash is stored
+type UserToken struct {
+	ID        uint       `gorm:"primaryKey"`
+	UserID    uint       `gorm:"not null;index"`
+	Purpose   string     `gorm:"size:32;not null"`
+	TokenHash string     `gorm:"size:64;not null;uniqueIndex"`
+	ExpiresAt time.Time  `gorm:"not null"`
+	UsedAt    *time.Time // also set when a newer token replaces this one
+	CreatedAt time.Time
+}
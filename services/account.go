@@ -0,0 +1,363 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"bbank/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrAccountNotFound   = errors.New("account not found")
+	ErrAccountNotActive  = errors.New("account is not active")
+	ErrUnfreezeForbidden = errors.New("a frozen account can only be unfrozen by staff")
+)
+
+type AccountService struct {
+	db              *gorm.DB
+	defaultCurrency string
+}
+
+type CreateAccountRequest struct {
+	Name     string `json:"name"`
+	Type     string `json:"type" binding:"omitempty,oneof=checking savings"`
+	Currency string `json:"currency" binding:"omitempty,len=3"`
+}
+
+// Fields left nil are not changed
+type UpdateAccountRequest struct {
+	Name      *string `json:"name"`
+	Type      *string `json:"type" binding:"omitempty,oneof=checking savings"`
+	Status    *string `json:"status" binding:"omitempty,oneof=active frozen"`
+	IsDefault *bool   `json:"is_default"`
+}
+
+type AccountStatusRequest struct {
+	Status string `json:"status" binding:"required,oneof=active frozen"`
+}
+
+func NewAccountService(db *gorm.DB, defaultCurrency string) *AccountService {
+	return &AccountService{
+		db:              db,
+		defaultCurrency: defaultCurrency,
+	}
+}
+
+// Open the default checking account of a newly registered user
+func (s *AccountService) CreateDefaultAccount(tx *gorm.DB, userID uint) (*models.Account, error) {
+	return s.openAccount(tx, userID, "Main", models.AccountTypeChecking, s.defaultCurrency, true)
+}
+
+// Open an additional account for a user
+func (s *AccountService) CreateAccount(userID uint, req CreateAccountRequest) (*models.Account, error) {
+	accountType := req.Type
+	if accountType == "" {
+		accountType = models.AccountTypeChecking
+	}
+	currency := models.NormalizeCurrency(req.Currency)
+	if currency == "" {
+		currency = s.defaultCurrency
+	}
+	if !models.IsSupportedCurrency(currency) {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedCurrency, currency)
+	}
+
+	var account *models.Account
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// The first account a user opens becomes their default
+		var defaults int64
+		if err := tx.Model(&models.Account{}).
+			Where("user_id = ? AND is_default", userID).
+			Count(&defaults).Error; err != nil {
+			return err
+		}
+
+		var err error
+		account, err = s.openAccount(tx, userID, req.Name, accountType, currency, defaults == 0)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return account, nil
+}
+
+// Get all accounts of a user with their balances
+func (s *AccountService) GetUserAccounts(userID uint) ([]models.Account, error) {
+	var accounts []models.Account
+	err := s.db.Where("user_id = ?", userID).
+		Preload("Balance").
+		Order("created_at ASC").
+		Find(&accounts).Error
+	if err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// Get a single account owned by the user
+func (s *AccountService) GetAccount(userID, accountID uint) (*models.Account, error) {
+	var account models.Account
+	err := s.db.Where("id = ? AND user_id = ?", accountID, userID).
+		Preload("Balance").
+		First(&account).Error
+	if err != nil {
+		return nil, ErrAccountNotFound
+	}
+	return &account, nil
+}
+
+// Update name, type, status or default flag of an account. Owners may
+// freeze their account but not unfreeze it.
+func (s *AccountService) UpdateAccount(userID, accountID uint, req UpdateAccountRequest) (*models.Account, error) {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		account, err := lockAccount(tx, accountID)
+		if err != nil || account.UserID != userID {
+			return ErrAccountNotFound
+		}
+		if account.Status == models.AccountStatusClosed {
+			return ErrAccountNotActive
+		}
+		if req.Status != nil && *req.Status != models.AccountStatusFrozen && account.Status == models.AccountStatusFrozen {
+			return ErrUnfreezeForbidden
+		}
+
+		updates := map[string]interface{}{}
+		if req.Name != nil {
+			updates["name"] = *req.Name
+		}
+		if req.Type != nil {
+			updates["type"] = *req.Type
+		}
+		if req.Status != nil {
+			updates["status"] = *req.Status
+		}
+
+		if req.IsDefault != nil {
+			if !*req.IsDefault && account.IsDefault {
+				return errors.New("choose another default account instead")
+			}
+			if *req.IsDefault && !account.IsDefault {
+				if err := tx.Model(&models.Account{}).
+					Where("user_id = ? AND is_default", userID).
+					Update("is_default", false).Error; err != nil {
+					return err
+				}
+				updates["is_default"] = true
+			}
+		}
+
+		if len(updates) == 0 {
+			return nil
+		}
+		if err := tx.Model(account).Updates(updates).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, "account", account.ID, "updated", updates)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetAccount(userID, accountID)
+}
+
+// Freeze or unfreeze any customer's account on behalf of a staff member
+func (s *AccountService) SetAccountStatus(accountID uint, status string, staffID uint) (*models.Account, error) {
+	var account *models.Account
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		account, err = lockAccount(tx, accountID)
+		if err != nil {
+			return ErrAccountNotFound
+		}
+		if account.Status == models.AccountStatusClosed {
+			return ErrAccountNotActive
+		}
+		if account.Status == status {
+			return nil
+		}
+
+		previous := account.Status
+		if err := tx.Model(account).Update("status", status).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, "account", account.ID, "status_changed", map[string]interface{}{
+			"from":       previous,
+			"to":         status,
+			"changed_by": staffID,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// Close an empty, non-default account
+func (s *AccountService) CloseAccount(userID, accountID uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		// Waits for money movements on the account, which hold a share lock,
+		// and keeps new ones out until the account is closed
+		account, err := lockAccount(tx, accountID)
+		if err != nil || account.UserID != userID {
+			return ErrAccountNotFound
+		}
+		if account.Status == models.AccountStatusClosed {
+			return nil
+		}
+		if account.IsDefault {
+			return errors.New("cannot close the default account")
+		}
+
+		var balance models.Balance
+		if err := tx.Where("account_id = ?", accountID).First(&balance).Error; err != nil {
+			return errors.New("balance not found")
+		}
+		if balance.Amount != 0 || balance.HeldAmount != 0 {
+			return errors.New("account balance must be zero to close it")
+		}
+
+		if err := tx.Model(account).Update("status", models.AccountStatusClosed).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, "account", account.ID, "closed", map[string]interface{}{"user_id": userID})
+	})
+}
+
+// Resolve an optional account ID to one of the user's accounts, falling
+// back to their default account
+func (s *AccountService) ResolveAccountID(userID uint, accountID *uint) (uint, error) {
+	account, err := s.ResolveAccount(userID, accountID)
+	if err != nil {
+		return 0, err
+	}
+	return account.ID, nil
+}
+
+// Like ResolveAccountID, returning the account
+func (s *AccountService) ResolveAccount(userID uint, accountID *uint) (*models.Account, error) {
+	var account models.Account
+	query := s.db.Where("user_id = ?", userID)
+	if accountID != nil {
+		query = query.Where("id = ?", *accountID)
+	} else {
+		query = query.Where("is_default")
+	}
+
+	if err := query.First(&account).Error; err != nil {
+		return nil, ErrAccountNotFound
+	}
+	return &account, nil
+}
+
+// Resolve the destination of a transfer: an explicit account of any user,
+// or the default account of the given user
+func (s *AccountService) ResolveRecipientAccountID(toUserID, toAccountID *uint) (uint, error) {
+	var account models.Account
+	switch {
+	case toAccountID != nil:
+		if err := s.db.First(&account, *toAccountID).Error; err != nil {
+			return 0, errors.New("recipient account not found")
+		}
+	case toUserID != nil:
+		if err := s.db.Where("user_id = ? AND is_default", *toUserID).First(&account).Error; err != nil {
+			return 0, errors.New("recipient account not found")
+		}
+	default:
+		return 0, errors.New("recipient account not found")
+	}
+	return account.ID, nil
+}
+
+func (s *AccountService) openAccount(tx *gorm.DB, userID uint, name, accountType, currency string, isDefault bool) (*models.Account, error) {
+	// The number is derived from the ID, so insert with a unique placeholder
+	account := models.Account{
+		UserID:    userID,
+		Number:    "pending-" + uuid.NewString(),
+		Name:      name,
+		Type:      accountType,
+		Currency:  currency,
+		Status:    models.AccountStatusActive,
+		IsDefault: isDefault,
+	}
+	if err := tx.Create(&account).Error; err != nil {
+		return nil, err
+	}
+
+	account.Number = models.AccountNumber(account.ID)
+	if err := tx.Model(&account).Update("number", account.Number).Error; err != nil {
+		return nil, err
+	}
+
+	balance := models.Balance{
+		AccountID:     account.ID,
+		UserID:        userID,
+		Amount:        0,
+		Currency:      currency,
+		LastUpdatedAt: time.Now(),
+	}
+	if err := tx.Create(&balance).Error; err != nil {
+		return nil, err
+	}
+	account.Balance = &balance
+
+	err := recordAudit(tx, "account", account.ID, "created", map[string]interface{}{
+		"user_id":  userID,
+		"number":   account.Number,
+		"currency": currency,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// Lock an account against money movements and other changes
+func lockAccount(tx *gorm.DB, accountID uint) (*models.Account, error) {
+	var account models.Account
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&account, accountID).Error; err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// Load an account for a money movement and make sure it can be used. The
+// share lock keeps it from being closed or frozen until tx ends.
+func loadActiveAccount(tx *gorm.DB, accountID uint) (*models.Account, error) {
+	var account models.Account
+	if err := tx.Clauses(clause.Locking{Strength: "SHARE"}).First(&account, accountID).Error; err != nil {
+		return nil, ErrAccountNotFound
+	}
+	if account.Status != models.AccountStatusActive {
+		return nil, ErrAccountNotActive
+	}
+	return &account, nil
+}
+
+// Load an active account and make sure it belongs to the user
+func loadOwnedAccount(tx *gorm.DB, userID, accountID uint) (*models.Account, error) {
+	account, err := loadActiveAccount(tx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if account.UserID != userID {
+		return nil, ErrAccountNotFound
+	}
+	return account, nil
+}
+
+// Reject amounts given in a currency other than the account's. An empty
+// currency means the account currency.
+func checkCurrency(account *models.Account, currency string) error {
+	if currency != "" && models.NormalizeCurrency(currency) != account.Currency {
+		return fmt.Errorf("%w: account %d holds %s", ErrCurrencyMismatch, account.ID, account.Currency)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"bbank/models"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	ErrInvalidAPIKey  = errors.New("invalid api key")
+)
+
+// Keys look like "bbk_<prefix>_<secret>"
+const (
+	apiKeyTag         = "bbk"
+	apiKeyTouchPeriod = time.Minute
+)
+
+type CreateAPIKeyRequest struct {
+	Name       string     `json:"name" binding:"required"`
+	Scopes     []string   `json:"scopes" binding:"required,min=1"`
+	AllowedIPs []string   `json:"allowed_ips"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+}
+
+// Returned once on creation, the only time the full key is visible
+type CreatedAPIKey struct {
+	Key    string        `json:"key"`
+	APIKey models.APIKey `json:"api_key"`
+}
+
+// Create an API key acting on behalf of the user
+func (s *AuthService) CreateAPIKey(userID uint, req CreateAPIKeyRequest) (*CreatedAPIKey, error) {
+	for _, scope := range req.Scopes {
+		if !models.IsValidScope(scope) {
+			return nil, fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	for _, allowed := range req.AllowedIPs {
+		if _, _, err := net.ParseCIDR(allowed); err != nil && net.ParseIP(allowed) == nil {
+			return nil, fmt.Errorf("invalid IP or CIDR %q", allowed)
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return nil, errors.New("expires_at must be in the future")
+	}
+
+	prefix := make([]byte, 4)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	prefixText := hex.EncodeToString(prefix)
+	key := apiKeyTag + "_" + prefixText + "_" + base64.RawURLEncoding.EncodeToString(secret)
+
+	apiKey := models.APIKey{
+		UserID:     userID,
+		Name:       req.Name,
+		Prefix:     prefixText,
+		KeyHash:    hashToken(key),
+		Scopes:     req.Scopes,
+		AllowedIPs: req.AllowedIPs,
+		ExpiresAt:  req.ExpiresAt,
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&apiKey).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, "api_key", apiKey.ID, "created", map[string]interface{}{
+			"user_id": userID,
+			"prefix":  apiKey.Prefix,
+			"scopes":  apiKey.Scopes,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &CreatedAPIKey{Key: key, APIKey: apiKey}, nil
+}
+
+// Get the API keys of a user, including revoked ones
+func (s *AuthService) GetAPIKeys(userID uint) ([]models.APIKey, error) {
+	var keys []models.APIKey
+	if err := s.db.Where("user_id = ?", userID).Order("created_at DESC").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Revoke one of the user's API keys
+func (s *AuthService) RevokeAPIKey(userID, keyID uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.APIKey{}).
+			Where("id = ? AND user_id = ? AND revoked_at IS NULL", keyID, userID).
+			Update("revoked_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrAPIKeyNotFound
+		}
+		return recordAudit(tx, "api_key", keyID, "revoked", map[string]interface{}{"user_id": userID})
+	})
+}
+
+// Check an API key presented from clientIP and return the identity it
+// acts as. The owner's current role applies, narrowed by the key scopes.
+func (s *AuthService) AuthenticateAPIKey(key, clientIP string) (*AccessClaims, error) {
+	parts := strings.SplitN(key, "_", 3)
+	if len(parts) != 3 || parts[0] != apiKeyTag {
+		return nil, ErrInvalidAPIKey
+	}
+
+	var apiKey models.APIKey
+	if err := s.db.Where("prefix = ?", parts[1]).First(&apiKey).Error; err != nil {
+		return nil, ErrInvalidAPIKey
+	}
+	if subtle.ConstantTimeCompare([]byte(apiKey.KeyHash), []byte(hashToken(key))) != 1 {
+		return nil, ErrInvalidAPIKey
+	}
+
+	now := time.Now()
+	if apiKey.RevokedAt != nil || (apiKey.ExpiresAt != nil && now.After(*apiKey.ExpiresAt)) {
+		return nil, ErrInvalidAPIKey
+	}
+	if !ipAllowed(apiKey.AllowedIPs, clientIP) {
+		return nil, errors.New("api key is not allowed from this address")
+	}
+
+	user, err := s.GetUserByID(apiKey.UserID)
+	if err != nil {
+		return nil, ErrInvalidAPIKey
+	}
+
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > apiKeyTouchPeriod {
+		if err := s.db.Model(&apiKey).Update("last_used_at", now).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	return &AccessClaims{
+		UserID:   user.ID,
+		Role:     user.Role,
+		APIKeyID: apiKey.ID,
+		IPBound:  len(apiKey.AllowedIPs) > 0,
+		Scopes:   apiKey.Scopes,
+	}, nil
+}
+
+func ipAllowed(allowed []string, clientIP string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	for _, entry := range allowed {
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if allowedIP := net.ParseIP(entry); allowedIP != nil && allowedIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,237 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"bbank/models"
+
+	"gorm.io/gorm"
+)
+
+// Class of the Postgres advisory locks serializing appends to each audit
+// chain; the second key is the hashed entity type
+const auditChainLock = 0x61756469 // "audi"
+
+var errChainBroken = errors.New("audit chain is broken")
+
+// Write an audit log entry as part of tx, linked to the latest entry of its
+// entity type. The chain's lock is held until tx ends, so call this after
+// taking any row locks.
+func recordAudit(tx *gorm.DB, entityType string, entityID uint, action string, details map[string]interface{}) error {
+	data, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+
+	return appendAudit(tx, &models.AuditLog{
+		EntityType: entityType,
+		EntityID:   entityID,
+		Action:     action,
+		Details:    data,
+	})
+}
+
+// Write an audit log entry in its own transaction
+func RecordAudit(db *gorm.DB, entityType string, entityID uint, action string, details map[string]interface{}) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		return recordAudit(tx, entityType, entityID, action, details)
+	})
+}
+
+func appendAudit(tx *gorm.DB, entry *models.AuditLog) error {
+	return appendAudits(tx, []models.AuditLog{*entry})
+}
+
+// Chain entries after the latest one of their entity type and insert them.
+// Entries without a time get the current one.
+func appendAudits(tx *gorm.DB, entries []models.AuditLog) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	types := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		types = append(types, entry.EntityType)
+	}
+	if err := lockAuditChains(tx, types...); err != nil {
+		return err
+	}
+
+	heads := make(map[string]string)
+	now := time.Now()
+	for i := range entries {
+		entry := &entries[i]
+		prevHash, ok := heads[entry.EntityType]
+		if !ok {
+			var err error
+			if prevHash, err = auditChainHead(tx, entry.EntityType); err != nil {
+				return err
+			}
+		}
+
+		if entry.CreatedAt.IsZero() {
+			entry.CreatedAt = now
+		}
+		// Postgres keeps microseconds; hash the value that will be read back
+		entry.CreatedAt = entry.CreatedAt.UTC().Truncate(time.Microsecond)
+		hash, err := entry.ChainHash(prevHash)
+		if err != nil {
+			return err
+		}
+		entry.PrevHash = prevHash
+		entry.Hash = hash
+		heads[entry.EntityType] = hash
+	}
+	return tx.Create(&entries).Error
+}
+
+// Take the chain locks of the entity types until tx ends. Locks are taken in
+// sorted order so that transactions appending to several chains can't
+// deadlock.
+func lockAuditChains(tx *gorm.DB, entityTypes ...string) error {
+	sorted := append([]string(nil), entityTypes...)
+	sort.Strings(sorted)
+	for i, entityType := range sorted {
+		if i > 0 && entityType == sorted[i-1] {
+			continue
+		}
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?, hashtext(?))", auditChainLock, entityType).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Hash of the latest entry of an entity type, which may have been archived
+func auditChainHead(tx *gorm.DB, entityType string) (string, error) {
+	var last models.AuditLog
+	err := tx.Select("id", "hash").
+		Where("entity_type = ?", entityType).
+		Order("id DESC").
+		Limit(1).
+		Find(&last).Error
+	if err != nil {
+		return "", err
+	}
+
+	var archived models.AuditArchiveSegment
+	err = tx.Where("entity_type = ?", entityType).
+		Order("last_id DESC").
+		Limit(1).
+		Find(&archived).Error
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case archived.ID != 0 && archived.LastID > last.ID:
+		return archived.LastHash, nil
+	case last.ID != 0:
+		return last.Hash, nil
+	}
+	return models.AuditGenesisHash, nil
+}
+
+// Outcome of checking the audit chains
+type AuditVerification struct {
+	Entries  int               `json:"entries"`
+	Archived int64             `json:"archived"` // entries skipped over using archive records
+	Heads    map[string]string `json:"heads"`    // latest hash per entity type; compare with recorded heads to detect truncation
+	BrokenAt uint              `json:"broken_at,omitempty"`
+	Problem  string            `json:"problem,omitempty"`
+}
+
+func (v *AuditVerification) OK() bool {
+	return v.Problem == ""
+}
+
+// Walk the audit chains in ID order, recomputing every hash. Archived runs
+// of a chain are skipped using their recorded first and last hashes.
+// Reports the first entry that was modified, or whose predecessor was
+// deleted.
+func VerifyAuditChain(db *gorm.DB) (*AuditVerification, error) {
+	result := &AuditVerification{Heads: make(map[string]string)}
+
+	var segments []models.AuditArchiveSegment
+	if err := db.Order("id").Find(&segments).Error; err != nil {
+		return nil, err
+	}
+	// Entity type -> hash the segment continues from
+	archived := make(map[string]map[string]models.AuditArchiveSegment)
+	for _, segment := range segments {
+		if archived[segment.EntityType] == nil {
+			archived[segment.EntityType] = make(map[string]models.AuditArchiveSegment)
+		}
+		if other, ok := archived[segment.EntityType][segment.FirstPrevHash]; ok {
+			result.Problem = fmt.Sprintf("archived %s entries %d and %d both continue from the same entry", segment.EntityType, other.FirstID, segment.FirstID)
+			return result, nil
+		}
+		archived[segment.EntityType][segment.FirstPrevHash] = segment
+	}
+
+	head := func(entityType string) string {
+		if hash, ok := result.Heads[entityType]; ok {
+			return hash
+		}
+		return models.AuditGenesisHash
+	}
+	// Follow archived runs from the head of a chain until it reaches hash,
+	// or as far as they go
+	skipArchived := func(entityType, hash string) {
+		for head(entityType) != hash {
+			segment, ok := archived[entityType][head(entityType)]
+			if !ok {
+				return
+			}
+			delete(archived[entityType], segment.FirstPrevHash)
+			result.Heads[entityType] = segment.LastHash
+			result.Archived += segment.Entries
+		}
+	}
+
+	var batch []models.AuditLog
+	err := db.FindInBatches(&batch, 1000, func(tx *gorm.DB, _ int) error {
+		for i := range batch {
+			entry := &batch[i]
+			skipArchived(entry.EntityType, entry.PrevHash)
+			if entry.PrevHash != head(entry.EntityType) {
+				result.BrokenAt = entry.ID
+				result.Problem = fmt.Sprintf("entry %d does not follow the previous %s entry, which was modified or deleted", entry.ID, entry.EntityType)
+				return errChainBroken
+			}
+			hash, err := entry.ChainHash(entry.PrevHash)
+			if err != nil {
+				return err
+			}
+			if hash != entry.Hash {
+				result.BrokenAt = entry.ID
+				result.Problem = fmt.Sprintf("entry %d was modified", entry.ID)
+				return errChainBroken
+			}
+			result.Heads[entry.EntityType] = entry.Hash
+			result.Entries++
+		}
+		return nil
+	}).Error
+	if errors.Is(err, errChainBroken) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Archives newer than any remaining entry, then any that never connected
+	for entityType := range archived {
+		skipArchived(entityType, "")
+	}
+	for entityType, rest := range archived {
+		for _, segment := range rest {
+			result.Problem = fmt.Sprintf("archived %s entries %d to %d do not connect to the chain", entityType, segment.FirstID, segment.LastID)
+			return result, nil
+		}
+	}
+	return result, nil
+}
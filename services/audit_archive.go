@@ -0,0 +1,380 @@
+package services
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"bbank/config"
+	"bbank/models"
+
+	"gorm.io/gorm"
+)
+
+const (
+	auditManifestFile = "manifest.json"
+	auditChecksumFile = "SHA256SUMS"
+)
+
+// Key of the Postgres advisory lock held while a partition is archived, so
+// that only one instance archives at a time
+const auditArchiveLock = 0x62616e6b61726368 // "bankarch"
+
+var errArchiveBusy = errors.New("another instance is archiving the audit log")
+
+type AuditArchiveConfig struct {
+	Dir       string // archive files, manifest.json and SHA256SUMS are written here
+	Retention config.AuditRetention
+}
+
+// Moves audit log partitions past their retention to gzipped NDJSON files
+// and drops them. Each file is listed in the manifest with its checksum and
+// the chain runs it holds, so the remaining chains stay verifiable.
+type AuditArchiver struct {
+	db     *gorm.DB
+	config AuditArchiveConfig
+}
+
+func NewAuditArchiver(db *gorm.DB, config AuditArchiveConfig) (*AuditArchiver, error) {
+	if config.Dir == "" {
+		return nil, errors.New("audit archive directory is required")
+	}
+	if err := os.MkdirAll(config.Dir, 0o750); err != nil {
+		return nil, err
+	}
+	return &AuditArchiver{db: db, config: config}, nil
+}
+
+// A leaf partition of audit_logs: one month of one partition group
+type auditPartition struct {
+	Name   string
+	Parent string
+	Group  string
+	Month  time.Time
+}
+
+// Create upcoming partitions and archive expired ones, then again every
+// interval until ctx is done
+func (a *AuditArchiver) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	now := time.Now()
+	for {
+		if err := config.EnsureAuditPartitions(a.db, a.config.Retention, now, now); err != nil {
+			log.Println("Failed to create audit partitions:", err)
+		}
+		if n, err := a.ArchiveExpired(now); err != nil {
+			log.Println("Failed to archive audit partitions:", err)
+		} else if n > 0 {
+			log.Printf("Archived %d audit partitions", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.C:
+		}
+	}
+}
+
+// Archive and drop every partition whose month ended longer ago than the
+// retention of its group, oldest first. Returns how many were archived.
+func (a *AuditArchiver) ArchiveExpired(now time.Time) (int, error) {
+	partitions, err := a.partitions()
+	if err != nil {
+		return 0, err
+	}
+
+	archived := 0
+	var archiveErr error
+	for _, partition := range partitions {
+		retention := a.config.Retention.For(partition.Group)
+		if retention <= 0 || partition.Month.AddDate(0, 1, 0).Add(retention).After(now) {
+			continue
+		}
+		err := a.archivePartition(partition)
+		if errors.Is(err, errArchiveBusy) {
+			break
+		}
+		if err != nil {
+			archiveErr = fmt.Errorf("archive %s: %w", partition.Name, err)
+			break
+		}
+		archived++
+	}
+
+	if archived > 0 {
+		if err := a.writeManifest(); err != nil && archiveErr == nil {
+			archiveErr = err
+		}
+	}
+	return archived, archiveErr
+}
+
+// Leaf partitions of audit_logs in month order
+func (a *AuditArchiver) partitions() ([]auditPartition, error) {
+	var rows []struct {
+		Name   string
+		Parent string
+	}
+	err := a.db.Raw(`SELECT c.relname AS name, p.relname AS parent
+		FROM pg_partition_tree('audit_logs') t
+		JOIN pg_class c ON c.oid = t.relid
+		JOIN pg_class p ON p.oid = t.parentrelid
+		WHERE t.isleaf`).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	partitions := make([]auditPartition, 0, len(rows))
+	for _, row := range rows {
+		month, err := time.Parse("200601", strings.TrimPrefix(row.Parent, config.AuditPartitionPrefix))
+		group, ok := strings.CutPrefix(row.Name, row.Parent+"_")
+		if err != nil || !ok {
+			log.Printf("Skipping audit partition %s, which was not created by bbank", row.Name)
+			continue
+		}
+		partitions = append(partitions, auditPartition{Name: row.Name, Parent: row.Parent, Group: group, Month: month})
+	}
+	sort.Slice(partitions, func(i, j int) bool {
+		if !partitions[i].Month.Equal(partitions[j].Month) {
+			return partitions[i].Month.Before(partitions[j].Month)
+		}
+		return partitions[i].Name < partitions[j].Name
+	})
+	return partitions, nil
+}
+
+// Write the partition to its archive file, then record the archive and drop
+// the partition in one transaction. A month restored for late entries is
+// archived again into a numbered file next to the first one.
+func (a *AuditArchiver) archivePartition(partition auditPartition) error {
+	return a.db.Transaction(func(tx *gorm.DB) error {
+		var locked bool
+		if err := tx.Raw("SELECT pg_try_advisory_xact_lock(?)", auditArchiveLock).Scan(&locked).Error; err != nil {
+			return err
+		}
+		if !locked {
+			return errArchiveBusy
+		}
+
+		var previous int64
+		if err := tx.Model(&models.AuditArchive{}).Where("partition = ?", partition.Name).Count(&previous).Error; err != nil {
+			return err
+		}
+		file := partition.Name + ".ndjson.gz"
+		if previous > 0 {
+			file = fmt.Sprintf("%s.%d.ndjson.gz", partition.Name, previous+1)
+		}
+		path := filepath.Join(a.config.Dir, file)
+
+		archive, err := exportPartition(tx, partition, path)
+		if err != nil {
+			return err
+		}
+		if err := dropPartition(tx, partition, archive); err != nil {
+			if archive != nil {
+				os.Remove(path)
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+// Write the entries of a partition, in ID order, to a gzipped NDJSON file
+// and split them into chain runs. Returns nil for an empty partition, which
+// needs no file.
+func exportPartition(tx *gorm.DB, partition auditPartition, path string) (*models.AuditArchive, error) {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+	defer file.Close()
+
+	digest := sha256.New()
+	compressed := gzip.NewWriter(io.MultiWriter(file, digest))
+	encoder := json.NewEncoder(compressed)
+
+	archive := &models.AuditArchive{
+		Partition:  partition.Name,
+		File:       filepath.Base(path),
+		RangeStart: partition.Month,
+		RangeEnd:   partition.Month.AddDate(0, 1, 0),
+	}
+	runs := make(map[string]int) // entity type -> index of its latest segment
+
+	var batch []models.AuditLog
+	err = tx.Table(partition.Name).FindInBatches(&batch, 1000, func(batchTx *gorm.DB, _ int) error {
+		for i := range batch {
+			entry := &batch[i]
+			// Once archived, a modified entry could no longer be noticed
+			hash, err := entry.ChainHash(entry.PrevHash)
+			if err != nil {
+				return err
+			}
+			if hash != entry.Hash {
+				return fmt.Errorf("entry %d was modified, verify the audit log", entry.ID)
+			}
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+
+			if last, ok := runs[entry.EntityType]; ok && archive.Segments[last].LastHash == entry.PrevHash {
+				segment := &archive.Segments[last]
+				segment.LastID = entry.ID
+				segment.LastHash = entry.Hash
+				segment.Entries++
+			} else {
+				runs[entry.EntityType] = len(archive.Segments)
+				archive.Segments = append(archive.Segments, models.AuditArchiveSegment{
+					EntityType:    entry.EntityType,
+					FirstID:       entry.ID,
+					LastID:        entry.ID,
+					Entries:       1,
+					FirstPrevHash: entry.PrevHash,
+					LastHash:      entry.Hash,
+				})
+			}
+			archive.Entries++
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+	if archive.Entries == 0 {
+		return nil, nil
+	}
+
+	if err := compressed.Close(); err != nil {
+		return nil, err
+	}
+	if err := file.Sync(); err != nil {
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	archive.SHA256 = hex.EncodeToString(digest.Sum(nil))
+	return archive, nil
+}
+
+// Record the archive and drop the partition, unless entries were added to
+// it since it was exported. archive is nil for an empty partition.
+func dropPartition(tx *gorm.DB, partition auditPartition, archive *models.AuditArchive) error {
+	// Late entries take their chain's lock, so none of the partition's types
+	// can arrive after this. The archive record joins the audit_log chain,
+	// which is locked up front to keep the lock order.
+	var types []string
+	if err := tx.Table(partition.Name).Distinct("entity_type").Pluck("entity_type", &types).Error; err != nil {
+		return err
+	}
+	if err := lockAuditChains(tx, append(types, "audit_log")...); err != nil {
+		return err
+	}
+	// Entries of other types could still land in a default partition
+	if err := tx.Exec(fmt.Sprintf("LOCK TABLE %q IN SHARE MODE", partition.Name)).Error; err != nil {
+		return err
+	}
+	var entries int64
+	if err := tx.Table(partition.Name).Count(&entries).Error; err != nil {
+		return err
+	}
+	exported := int64(0)
+	if archive != nil {
+		exported = archive.Entries
+	}
+	if entries != exported {
+		return fmt.Errorf("%d entries were added while archiving", entries-exported)
+	}
+
+	// Dropping needs an exclusive lock on audit_logs; give up rather than
+	// stall every writer behind a long export
+	if err := tx.Exec("SET LOCAL lock_timeout = '10s'").Error; err != nil {
+		return err
+	}
+	if archive != nil {
+		if err := tx.Create(archive).Error; err != nil {
+			return err
+		}
+	}
+	if err := tx.Exec(fmt.Sprintf("DROP TABLE %q", partition.Name)).Error; err != nil {
+		return err
+	}
+
+	var remaining int64
+	err := tx.Raw("SELECT COUNT(*) FROM pg_inherits WHERE inhparent = to_regclass(?)", partition.Parent).Scan(&remaining).Error
+	if err != nil {
+		return err
+	}
+	if remaining == 0 {
+		if err := tx.Exec(fmt.Sprintf("DROP TABLE %q", partition.Parent)).Error; err != nil {
+			return err
+		}
+	}
+
+	if archive == nil {
+		return nil
+	}
+	return recordAudit(tx, "audit_log", 0, "archived", map[string]interface{}{
+		"partition": archive.Partition,
+		"file":      archive.File,
+		"sha256":    archive.SHA256,
+		"entries":   archive.Entries,
+	})
+}
+
+// Contents of manifest.json
+type auditManifest struct {
+	UpdatedAt time.Time             `json:"updated_at"`
+	Archives  []models.AuditArchive `json:"archives"`
+}
+
+// Rewrite the manifest and the checksum file, which sha256sum -c accepts,
+// from the archive records
+func (a *AuditArchiver) writeManifest() error {
+	var archives []models.AuditArchive
+	if err := a.db.Preload("Segments").Order("id").Find(&archives).Error; err != nil {
+		return err
+	}
+
+	manifest, err := json.MarshalIndent(auditManifest{UpdatedAt: time.Now().UTC(), Archives: archives}, "", "  ")
+	if err != nil {
+		return err
+	}
+	var checksums strings.Builder
+	for _, archive := range archives {
+		fmt.Fprintf(&checksums, "%s  %s\n", archive.SHA256, archive.File)
+	}
+
+	if err := writeFileAtomic(filepath.Join(a.config.Dir, auditManifestFile), append(manifest, '\n')); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(a.config.Dir, auditChecksumFile), []byte(checksums.String()))
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,190 @@
+package services
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"bbank/models"
+
+	"gorm.io/gorm"
+)
+
+const (
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 1000
+	auditExportBatchSize = 500
+)
+
+// Export formats of the audit log
+const (
+	AuditFormatCSV    = "csv"
+	AuditFormatNDJSON = "ndjson"
+)
+
+// Dotted path into Details, e.g. "user_id" or "request.path"
+var auditDetailPath = regexp.MustCompile(`^[A-Za-z0-9_]+(\.[A-Za-z0-9_]+)*$`)
+
+type AuditService struct {
+	db *gorm.DB
+}
+
+func NewAuditService(db *gorm.DB) *AuditService {
+	return &AuditService{db: db}
+}
+
+// Filters on the audit log. Details matches the text value at each dotted
+// path, so {"user_id": "7"} finds entries whose details.user_id is 7 or "7".
+type AuditQuery struct {
+	EntityType string            `json:"entity_type,omitempty"`
+	EntityID   *uint             `json:"entity_id,omitempty"`
+	Action     string            `json:"action,omitempty"`
+	From       *time.Time        `json:"from,omitempty"` // inclusive
+	To         *time.Time        `json:"to,omitempty"`   // exclusive
+	Details    map[string]string `json:"details,omitempty"`
+}
+
+// A page of entries, newest first. NextCursor is empty on the last page.
+type AuditPage struct {
+	Entries    []models.AuditLog `json:"audit_logs"`
+	Count      int               `json:"count"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+}
+
+// Get entries matching query, newest first, starting after cursor
+func (s *AuditService) Search(query AuditQuery, cursor string, limit int) (*AuditPage, error) {
+	if limit <= 0 {
+		limit = defaultAuditPageSize
+	}
+	limit = min(limit, maxAuditPageSize)
+
+	db, err := s.filter(query)
+	if err != nil {
+		return nil, err
+	}
+	if cursor != "" {
+		before, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid cursor")
+		}
+		db = db.Where("id < ?", before)
+	}
+
+	var entries []models.AuditLog
+	if err := db.Order("id DESC").Limit(limit + 1).Find(&entries).Error; err != nil {
+		return nil, err
+	}
+
+	page := &AuditPage{Entries: entries}
+	if len(entries) > limit {
+		page.Entries = entries[:limit]
+		page.NextCursor = strconv.FormatUint(uint64(page.Entries[limit-1].ID), 10)
+	}
+	page.Count = len(page.Entries)
+	return page, nil
+}
+
+// Stream every entry matching query to w in ID order. The export itself
+// is recorded in the audit log.
+func (s *AuditService) Export(w io.Writer, query AuditQuery, format string, exportedBy uint) error {
+	var write func(*models.AuditLog) error
+	var flush func() error
+	switch format {
+	case AuditFormatCSV:
+		out := csv.NewWriter(w)
+		if err := out.Write([]string{"id", "created_at", "entity_type", "entity_id", "action", "details", "prev_hash", "hash"}); err != nil {
+			return err
+		}
+		write = func(entry *models.AuditLog) error {
+			return out.Write([]string{
+				strconv.FormatUint(uint64(entry.ID), 10),
+				entry.CreatedAt.UTC().Format(time.RFC3339Nano),
+				entry.EntityType,
+				strconv.FormatUint(uint64(entry.EntityID), 10),
+				entry.Action,
+				string(entry.Details),
+				entry.PrevHash,
+				entry.Hash,
+			})
+		}
+		flush = func() error {
+			out.Flush()
+			return out.Error()
+		}
+	case AuditFormatNDJSON:
+		encoder := json.NewEncoder(w)
+		write = func(entry *models.AuditLog) error {
+			return encoder.Encode(entry)
+		}
+		flush = func() error { return nil }
+	default:
+		return fmt.Errorf("unknown export format %q", format)
+	}
+
+	db, err := s.filter(query)
+	if err != nil {
+		return err
+	}
+
+	// Recorded first so that a failed or aborted download is still visible
+	err = RecordAudit(s.db, "audit_log", exportedBy, "exported", map[string]interface{}{
+		"format":  format,
+		"filters": query,
+	})
+	if err != nil {
+		return err
+	}
+
+	var batch []models.AuditLog
+	err = db.FindInBatches(&batch, auditExportBatchSize, func(tx *gorm.DB, _ int) error {
+		for i := range batch {
+			if err := write(&batch[i]); err != nil {
+				return err
+			}
+		}
+		// Hand each batch to the client instead of buffering the export
+		if err := flush(); err != nil {
+			return err
+		}
+		if f, ok := w.(interface{ Flush() }); ok {
+			f.Flush()
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+func (s *AuditService) filter(query AuditQuery) (*gorm.DB, error) {
+	db := s.db.Model(&models.AuditLog{})
+	if query.EntityType != "" {
+		db = db.Where("entity_type = ?", query.EntityType)
+	}
+	if query.EntityID != nil {
+		db = db.Where("entity_id = ?", *query.EntityID)
+	}
+	if query.Action != "" {
+		db = db.Where("action = ?", query.Action)
+	}
+	if query.From != nil {
+		db = db.Where("created_at >= ?", *query.From)
+	}
+	if query.To != nil {
+		db = db.Where("created_at < ?", *query.To)
+	}
+	for path, value := range query.Details {
+		if !auditDetailPath.MatchString(path) {
+			return nil, fmt.Errorf("invalid details filter %q", path)
+		}
+		db = db.Where("details #>> CAST(? AS text[]) = ?", "{"+strings.ReplaceAll(path, ".", ",")+"}", value)
+	}
+	return db, nil
+}
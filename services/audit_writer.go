@@ -0,0 +1,417 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bbank/config"
+	"bbank/models"
+
+	"gorm.io/gorm"
+)
+
+// What AuditWriter.Write does when the queue is full
+type AuditOverflow string
+
+const (
+	AuditOverflowBlock AuditOverflow = "block" // wait for room, slowing the request down
+	AuditOverflowDrop  AuditOverflow = "drop"  // discard the entry and count it
+	AuditOverflowSpill AuditOverflow = "spill" // append the entry to the spill file
+)
+
+const (
+	auditWriteAttempts = 3
+	auditSyncTimeout   = 5 * time.Second // per entry written after Close
+)
+
+func ParseAuditOverflow(s string) (AuditOverflow, error) {
+	switch policy := AuditOverflow(s); policy {
+	case AuditOverflowBlock, AuditOverflowDrop, AuditOverflowSpill:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown audit overflow policy %q", s)
+}
+
+type AuditWriterConfig struct {
+	QueueSize  int
+	BatchSize  int
+	FlushEvery time.Duration // longest time an entry waits for its batch
+	Overflow   AuditOverflow
+	SpillFile  string                // NDJSON file taking entries the database could not; required for "spill"
+	Retention  config.AuditRetention // partitions replayed entries of past months are restored with
+}
+
+// Counters of an AuditWriter
+type AuditWriterStats struct {
+	Queued  int   `json:"queued"`
+	Written int64 `json:"written"`
+	Dropped int64 `json:"dropped"`
+	Spilled int64 `json:"spilled"`
+}
+
+// Writes audit entries that are not part of a domain transaction, such as
+// request logs, in batches from a single goroutine. Entries the database
+// rejects go to the spill file and are replayed on the next start.
+type AuditWriter struct {
+	db      *gorm.DB
+	config  AuditWriterConfig
+	queue   chan models.AuditLog
+	done    chan struct{}
+	closing chan struct{}   // closed when Close starts, waking blocked writers
+	ctx     context.Context // canceled when Close runs out of time
+	abort   context.CancelFunc
+
+	mu        sync.RWMutex // held for reading while sending to queue
+	closed    bool
+	closeOnce sync.Once
+	spillMu   sync.Mutex
+
+	written atomic.Int64
+	dropped atomic.Int64
+	spilled atomic.Int64
+}
+
+func NewAuditWriter(db *gorm.DB, config AuditWriterConfig) (*AuditWriter, error) {
+	if config.QueueSize <= 0 || config.BatchSize <= 0 || config.FlushEvery <= 0 {
+		return nil, errors.New("audit queue size, batch size and flush interval must be positive")
+	}
+	if config.Overflow == AuditOverflowSpill && config.SpillFile == "" {
+		return nil, errors.New("the spill overflow policy needs a spill file")
+	}
+
+	w := &AuditWriter{
+		db:      db,
+		config:  config,
+		queue:   make(chan models.AuditLog, config.QueueSize),
+		done:    make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+	w.ctx, w.abort = context.WithCancel(context.Background())
+	if err := w.replaySpill(); err != nil {
+		// The file is kept and replayed on the next start
+		log.Printf("Failed to replay audit spill file %s: %v", config.SpillFile, err)
+	}
+
+	go w.run()
+	return w, nil
+}
+
+// Queue an entry, applying the overflow policy when the queue is full
+func (w *AuditWriter) Write(entityType string, entityID uint, action string, details map[string]interface{}) {
+	data, err := json.Marshal(details)
+	if err != nil {
+		log.Printf("Failed to encode %s audit entry: %v", action, err)
+		return
+	}
+	entry := models.AuditLog{
+		EntityType: entityType,
+		EntityID:   entityID,
+		Action:     action,
+		Details:    data,
+		CreatedAt:  time.Now(),
+	}
+
+	w.mu.RLock()
+	queued := !w.closed && w.enqueue(entry)
+	w.mu.RUnlock()
+	if !queued {
+		// Shutting down: write synchronously rather than lose the entry.
+		// w.ctx may already be canceled, so it gets a context of its own.
+		ctx, cancel := context.WithTimeout(context.Background(), auditSyncTimeout)
+		defer cancel()
+		w.flush(ctx, []models.AuditLog{entry})
+	}
+}
+
+// Send an entry to the queue, applying the overflow policy. Reports false
+// if Close started while waiting for room.
+func (w *AuditWriter) enqueue(entry models.AuditLog) bool {
+	if w.config.Overflow == AuditOverflowBlock {
+		select {
+		case w.queue <- entry:
+			return true
+		case <-w.closing:
+			return false
+		}
+	}
+	select {
+	case w.queue <- entry:
+	default:
+		if w.config.Overflow == AuditOverflowSpill {
+			w.spill([]models.AuditLog{entry})
+		} else {
+			w.dropped.Add(1)
+		}
+	}
+	return true
+}
+
+func (w *AuditWriter) Stats() AuditWriterStats {
+	return AuditWriterStats{
+		Queued:  len(w.queue),
+		Written: w.written.Load(),
+		Dropped: w.dropped.Load(),
+		Spilled: w.spilled.Load(),
+	}
+}
+
+// Stop queueing and write out the entries already queued; later writes go
+// straight to the database. If the queue does not drain before ctx ends,
+// the rest is spilled and ctx.Err() returned.
+func (w *AuditWriter) Close(ctx context.Context) error {
+	// Writers waiting for room in the queue give up, so mu is free
+	w.closeOnce.Do(func() { close(w.closing) })
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+
+	var err error
+	select {
+	case <-w.done:
+	case <-ctx.Done():
+		// Out of time: have run keep what is left in the spill file
+		w.abort()
+		<-w.done
+		err = ctx.Err()
+	}
+
+	stats := w.Stats()
+	log.Printf("Audit writer stopped: %d written, %d dropped, %d spilled", stats.Written, stats.Dropped, stats.Spilled)
+	return err
+}
+
+func (w *AuditWriter) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.config.FlushEvery)
+	defer ticker.Stop()
+
+	batch := make([]models.AuditLog, 0, w.config.BatchSize)
+	for {
+		select {
+		case entry, ok := <-w.queue:
+			if !ok {
+				w.flush(w.ctx, batch)
+				return
+			}
+			batch = append(batch, entry)
+			if len(batch) < w.config.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-w.ctx.Done():
+			// Close closed the queue before aborting, so this ends
+			for entry := range w.queue {
+				batch = append(batch, entry)
+			}
+			w.discard(batch)
+			return
+		}
+
+		w.flush(w.ctx, batch)
+		batch = batch[:0]
+	}
+}
+
+// Insert a batch, retrying briefly before falling back to the spill file
+func (w *AuditWriter) flush(ctx context.Context, batch []models.AuditLog) {
+	if len(batch) == 0 {
+		return
+	}
+
+	var err error
+	for attempt := 1; attempt <= auditWriteAttempts; attempt++ {
+		entries := append([]models.AuditLog(nil), batch...)
+		err = w.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			return appendAudits(tx, entries)
+		})
+		if err == nil {
+			w.written.Add(int64(len(batch)))
+			return
+		}
+		select {
+		case <-ctx.Done():
+			attempt = auditWriteAttempts
+		case <-time.After(time.Duration(attempt) * 100 * time.Millisecond):
+		}
+	}
+
+	log.Printf("Failed to write %d audit entries: %v", len(batch), err)
+	w.discard(batch)
+}
+
+// Keep entries that could not be written in the spill file, if there is one
+func (w *AuditWriter) discard(entries []models.AuditLog) {
+	if w.config.SpillFile != "" {
+		w.spill(entries)
+	} else {
+		w.dropped.Add(int64(len(entries)))
+	}
+}
+
+// Append entries to the spill file, one JSON object per line
+func (w *AuditWriter) spill(entries []models.AuditLog) {
+	if len(entries) == 0 {
+		return
+	}
+	w.spillMu.Lock()
+	defer w.spillMu.Unlock()
+
+	file, err := os.OpenFile(w.config.SpillFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Printf("Failed to open audit spill file, %d entries lost: %v", len(entries), err)
+		w.dropped.Add(int64(len(entries)))
+		return
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	for i := range entries {
+		if err := encoder.Encode(&entries[i]); err != nil {
+			log.Printf("Failed to spill audit entry: %v", err)
+			w.dropped.Add(1)
+			continue
+		}
+		w.spilled.Add(1)
+	}
+}
+
+// Write the entries of a previous run's spill file to the database and
+// remove the file. Lines that can not be read or that the database rejects
+// are appended to the quarantine file instead, so that they do not hold up
+// the rest on every start.
+func (w *AuditWriter) replaySpill() error {
+	if w.config.SpillFile == "" {
+		return nil
+	}
+	file, err := os.Open(w.config.SpillFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var (
+		entries []models.AuditLog
+		lines   [][]byte // spill file line of each entry
+		bad     [][]byte
+	)
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			var entry models.AuditLog
+			if jsonErr := json.Unmarshal(line, &entry); jsonErr != nil {
+				log.Printf("Quarantining unreadable audit spill line: %v", jsonErr)
+				bad = append(bad, line)
+			} else {
+				entry.ID, entry.PrevHash, entry.Hash = 0, "", ""
+				entries = append(entries, entry)
+				lines = append(lines, line)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Entries of a month that was archived meanwhile need its partition
+	// back. If that fails, their inserts fail and they are quarantined.
+	months := make(map[time.Time]bool)
+	for _, entry := range entries {
+		month := config.AuditMonth(entry.CreatedAt)
+		if entry.CreatedAt.IsZero() || months[month] {
+			continue
+		}
+		months[month] = true
+		if err := config.EnsureAuditMonth(w.db, w.config.Retention, month); err != nil {
+			log.Printf("Failed to restore audit partition for replay: %v", err)
+		}
+	}
+
+	// Each batch goes in a savepoint; a batch the database rejects is
+	// retried entry by entry to find the ones to quarantine
+	insert := func(tx *gorm.DB, batch []models.AuditLog) error {
+		batch = append([]models.AuditLog(nil), batch...)
+		return tx.Transaction(func(tx *gorm.DB) error {
+			return appendAudits(tx, batch)
+		})
+	}
+	replayed := 0
+	err = w.db.Transaction(func(tx *gorm.DB) error {
+		for start := 0; start < len(entries); start += w.config.BatchSize {
+			end := min(start+w.config.BatchSize, len(entries))
+			if insert(tx, entries[start:end]) == nil {
+				replayed += end - start
+				continue
+			}
+			for i := start; i < end; i++ {
+				if err := insert(tx, entries[i:i+1]); err != nil {
+					log.Printf("Quarantining audit spill entry the database rejects: %v", err)
+					bad = append(bad, lines[i])
+					continue
+				}
+				replayed++
+			}
+		}
+		// Before committing, so that no line is lost if this fails
+		return w.quarantine(bad)
+	})
+	if err != nil {
+		return err
+	}
+	if replayed > 0 {
+		log.Printf("Replayed %d spilled audit entries", replayed)
+	}
+	if len(bad) > 0 {
+		log.Printf("Moved %d spilled audit entries to %s, check them by hand", len(bad), w.quarantineFile())
+	}
+
+	file.Close()
+	return os.Remove(w.config.SpillFile)
+}
+
+// Spill file lines that could not be replayed are kept here
+func (w *AuditWriter) quarantineFile() string {
+	return w.config.SpillFile + ".bad"
+}
+
+// Append lines to the quarantine file and sync it
+func (w *AuditWriter) quarantine(lines [][]byte) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	file, err := os.OpenFile(w.quarantineFile(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for _, line := range lines {
+		if _, err := file.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	return file.Close()
+}
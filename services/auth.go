@@ -2,18 +2,41 @@ package services
 
 import (
 	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
 	"time"
 
 	"bbank/models"
 
 	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
+var (
+	ErrUserNotFound            = errors.New("user not found")
+	ErrUserExists              = errors.New("user with this email or username already exists")
+	ErrFieldForbidden          = errors.New("not allowed to change this field")
+	ErrUnknownRole             = errors.New("unknown role")
+	ErrCurrentPasswordRequired = errors.New("current_password is required to change the password")
+	ErrWrongCurrentPassword    = errors.New("current password is incorrect")
+)
+
 type AuthService struct {
-	db        *gorm.DB
-	jwtSecret string
+	db              *gorm.DB
+	keys            *KeyManager
+	refreshTokenTTL time.Duration
+	loginPolicy     LoginPolicy
+	passwords       PasswordPolicy
+	accountService  *AccountService
+	mailer          Mailer
+	appBaseURL      string // prefix of links in emails
+	auditWriter     *AuditWriter
+
+	dummyHashOnce sync.Once
+	dummyHash     string // checked against for unknown emails
 }
 
 type LoginRequest struct {
@@ -24,7 +47,19 @@ type LoginRequest struct {
 type RegisterRequest struct {
 	Username string `json:"username" binding:"required"`
 	Email    string `json:"email" binding:"required,email"`
-	Password string `json:"password" binding:"required,min=6"`
+	Password string `json:"password" binding:"required"` // checked against the PasswordPolicy
+}
+
+// Identity carried by a validated access token or API key
+type AccessClaims struct {
+	UserID    uint
+	Role      string
+	SessionID string   // empty for API keys and delegated tokens
+	TokenID   string   // jti
+	APIKeyID  uint     // set when authenticated with an API key
+	IPBound   bool     // the API key is restricted to an IP allow-list
+	ClientID  string   // set for tokens issued to an OAuth client
+	Scopes    []string // API key or delegated token scopes
 }
 
 type AuthResponse struct {
@@ -33,23 +68,34 @@ type AuthResponse struct {
 	User         models.User `json:"user"`
 }
 
-func NewAuthService(db *gorm.DB, jwtSecret string) *AuthService {
+func NewAuthService(db *gorm.DB, keys *KeyManager, refreshTokenTTL time.Duration, loginPolicy LoginPolicy, passwords PasswordPolicy, accountService *AccountService, mailer Mailer, appBaseURL string, auditWriter *AuditWriter) *AuthService {
 	return &AuthService{
-		db:        db,
-		jwtSecret: jwtSecret,
+		db:              db,
+		keys:            keys,
+		refreshTokenTTL: refreshTokenTTL,
+		loginPolicy:     loginPolicy,
+		passwords:       passwords,
+		accountService:  accountService,
+		mailer:          mailer,
+		appBaseURL:      strings.TrimRight(appBaseURL, "/"),
+		auditWriter:     auditWriter,
 	}
 }
 
 // Register new user
-func (s *AuthService) Register(req RegisterRequest) (*AuthResponse, error) {
+func (s *AuthService) Register(req RegisterRequest, client ClientInfo) (*AuthResponse, error) {
 	// Check if user already exists
 	var existingUser models.User
 	if err := s.db.Where("email = ? OR username = ?", req.Email, req.Username).First(&existingUser).Error; err == nil {
-		return nil, errors.New("user with this email or username already exists")
+		return nil, ErrUserExists
+	}
+
+	if err := s.passwords.Check(req.Password); err != nil {
+		return nil, err
 	}
 
 	// Hash password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	hashedPassword, err := s.hashPassword(req.Password)
 	if err != nil {
 		return nil, err
 	}
@@ -58,24 +104,36 @@ func (s *AuthService) Register(req RegisterRequest) (*AuthResponse, error) {
 	user := models.User{
 		Username: req.Username,
 		Email:    req.Email,
-		Password: string(hashedPassword),
-		Role:     "user",
+		Password: hashedPassword,
+		Role:     models.RoleUser,
 	}
 
-	if err := s.db.Create(&user).Error; err != nil {
+	// Create the user together with their default account and balance
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		if err := s.recordPasswordHistory(tx, user.ID, user.Password); err != nil {
+			return err
+		}
+		if _, err := s.accountService.CreateDefaultAccount(tx, user.ID); err != nil {
+			return err
+		}
+		return recordAudit(tx, "user", user.ID, "created", map[string]interface{}{
+			"username": user.Username,
+			"email":    user.Email,
+			"role":     user.Role,
+		})
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	// Create initial balance
-	balance := models.Balance{
-		UserID:        user.ID,
-		Amount:        0.0,
-		LastUpdatedAt: time.Now(),
-	}
-	s.db.Create(&balance)
+	// Money movement stays blocked until the address is confirmed
+	s.sendWelcomeVerification(user.ID)
 
 	// Generate JWT token
-	access_token, refresh_token, err := s.GenerateToken(user.ID)
+	access_token, refresh_token, err := s.GenerateToken(user.ID, user.Role, client)
 	if err != nil {
 		return nil, err
 	}
@@ -87,93 +145,135 @@ func (s *AuthService) Register(req RegisterRequest) (*AuthResponse, error) {
 	}, nil
 }
 
-// Login user
-func (s *AuthService) Login(req LoginRequest) (*AuthResponse, error) {
+// Login user. Users with 2FA enabled get a challenge instead of tokens,
+// to be completed with CompleteTwoFactorLogin.
+func (s *AuthService) Login(req LoginRequest, client ClientInfo) (*AuthResponse, *TwoFactorChallenge, error) {
+	if err := s.checkLoginAllowed(req.Email, client); err != nil {
+		return nil, nil, err
+	}
+
 	// Find user by email
 	var user models.User
 	if err := s.db.Where("email = ?", req.Email).First(&user).Error; err != nil {
-		return nil, errors.New("invalid email or password")
+		s.verifyDummyPassword(req.Password)
+		s.recordLoginFailure(0, req.Email, client, "unknown_email")
+		return nil, nil, ErrInvalidCredentials
 	}
 
 	// Check password
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
-		return nil, errors.New("invalid email or password")
+	ok, rehash := s.verifyPassword(user.Password, req.Password)
+	if !ok {
+		s.recordLoginFailure(user.ID, req.Email, client, "wrong_password")
+		return nil, nil, ErrInvalidCredentials
+	}
+	// Move hashes made with an older algorithm or cost to the current one
+	if rehash {
+		if err := s.rehashPassword(&user, req.Password); err != nil {
+			log.Printf("Failed to rehash password of user %d: %v", user.ID, err)
+		}
+	}
+
+	if user.TOTPEnabled {
+		// The code is counted as an attempt of its own
+		s.releaseLoginAttempt(user.Email, client)
+		challenge, err := s.issueChallenge(user.ID)
+		return nil, challenge, err
 	}
 
+	s.recordLoginSuccess(&user, client)
+
 	// Generate JWT token
-	access_token, refresh_token, err := s.GenerateToken(user.ID)
+	access_token, refresh_token, err := s.GenerateToken(user.ID, user.Role, client)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	return &AuthResponse{
 		AccessToken:  access_token,
 		RefreshToken: refresh_token,
 		User:         user,
-	}, nil
+	}, nil, nil
 }
 
-// Generate JWT token
-func (s *AuthService) GenerateToken(userID uint) (access_token string, refresh_token string, err error) {
+// Start a new session and generate its first access and refresh token
+func (s *AuthService) GenerateToken(userID uint, role string, client ClientInfo) (access_token string, refresh_token string, err error) {
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		session, err := s.startSession(tx, userID, client)
+		if err != nil {
+			return err
+		}
+		access_token, refresh_token, err = s.issueTokens(tx, userID, role, session.ID)
+		return err
+	})
+	return access_token, refresh_token, err
+}
+
+func (s *AuthService) signAccessToken(userID uint, role, sessionID string) (string, error) {
 	accessClaims := jwt.MapClaims{
 		"user_id": userID,
+		"role":    role,
+		"sid":     sessionID,
+		"jti":     uuid.NewString(),
 		"exp":     time.Now().Add(time.Hour * 24).Unix(), // 24 hours
 		"iat":     time.Now().Unix(),
 		"type":    "access",
 	}
 
-	access := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims)
-	accessToken, err := access.SignedString([]byte(s.jwtSecret))
-
-	// Generate refresh token
-	refreshClaims := jwt.MapClaims{
-		"user_id": userID,
-		"exp":     time.Now().Add(time.Hour * 24 * 30).Unix(), // 30 days
-		"iat":     time.Now().Unix(),
-		"type":    "refresh",
-	}
-
-	refresh := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims)
-	refreshToken, err := refresh.SignedString([]byte(s.jwtSecret))
-
-	return accessToken, refreshToken, err
+	return s.keys.Sign(accessClaims)
 }
 
 // Validate JWT token
-func (s *AuthService) ValidateToken(tokenString string) (uint, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return []byte(s.jwtSecret), nil
-	})
+func (s *AuthService) ValidateToken(tokenString string) (*AccessClaims, error) {
+	token, err := s.keys.Parse(tokenString)
 
 	if err != nil || !token.Valid {
-		return 0, errors.New("invalid token")
+		return nil, errors.New("invalid token")
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
+	if ok && claims["type"] == "oauth_access" {
+		return s.validateOAuthClaims(claims)
+	}
 	if !ok || claims["type"] != "access" {
-		return 0, errors.New("invalid access token")
+		return nil, errors.New("invalid access token")
 	}
 
-	userID := uint(claims["user_id"].(float64))
-	return userID, nil
-}
-
-func (s *AuthService) ValidateRefreshToken(tokenString string) (uint, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return []byte(s.jwtSecret), nil
-	})
-
-	if err != nil || !token.Valid {
-		return 0, errors.New("invalid refresh token")
+	userID, ok := claims["user_id"].(float64)
+	if !ok {
+		return nil, errors.New("invalid access token")
 	}
-
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok || claims["type"] != "refresh" {
-		return 0, errors.New("invalid refresh token")
+	sessionID, _ := claims["sid"].(string)
+	if sessionID == "" {
+		return nil, errors.New("invalid access token")
 	}
+	if err := s.checkSession(sessionID, uint(userID)); err != nil {
+		return nil, errors.New("session has been revoked")
+	}
+
+	role, _ := claims["role"].(string)
+	tokenID, _ := claims["jti"].(string)
 
-	userID := uint(claims["user_id"].(float64))
-	return userID, nil
+	return &AccessClaims{UserID: uint(userID), Role: role, SessionID: sessionID, TokenID: tokenID}, nil
+}
+
+// Give the admin role to the user with the given email, if they exist
+func (s *AuthService) EnsureAdmin(email string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		result := tx.Where("email = ? AND role <> ?", email, models.RoleAdmin).Limit(1).Find(&user)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		previousRole := user.Role
+		if err := tx.Model(&user).Update("role", models.RoleAdmin).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, "user", user.ID, "role_changed", map[string]interface{}{
+			"from":       previousRole,
+			"to":         models.RoleAdmin,
+			"changed_by": "ADMIN_EMAIL",
+		})
+	})
 }
 
 // Get all users
@@ -194,42 +294,196 @@ func (s *AuthService) GetUserByID(userID uint) (*models.User, error) {
 	return &user, nil
 }
 
-// Update user details
-func (s *AuthService) UpdateUser(userID uint, updatedUser models.User) (*models.User, error) {
-	var user models.User
-	if err := s.db.First(&user, userID).Error; err != nil {
-		return nil, err
-	}
+// Partial update of a user; omitted fields are left unchanged
+type UpdateUserRequest struct {
+	Username        *string `json:"username" binding:"omitempty,min=3"`
+	Email           *string `json:"email" binding:"omitempty,email"`
+	Password        *string `json:"password"`
+	CurrentPassword string  `json:"current_password"` // required to change one's own password
+	Role            *string `json:"role"`             // needs users:manage
+}
 
-	// Update fields
-	user.Username = updatedUser.Username
-	user.Email = updatedUser.Email
+// Update user details on behalf of actor. Changing the email requires it
+// to be verified again; changing the password or role ends the user's
+// other sessions so that stale tokens stop working.
+func (s *AuthService) UpdateUser(userID uint, req UpdateUserRequest, actor AccessClaims, client ClientInfo) (*models.User, error) {
+	self := actor.UserID == userID
+	if req.Role != nil && !models.HasPermission(actor.Role, models.PermUsersManage) {
+		return nil, ErrFieldForbidden
+	}
+	if req.Role != nil && !models.IsValidRole(*req.Role) {
+		return nil, fmt.Errorf("%w %q", ErrUnknownRole, *req.Role)
+	}
 
-	if updatedUser.Password != "" {
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(updatedUser.Password), bcrypt.DefaultCost)
+	// Checking the current password counts as a login attempt, so that a
+	// stolen access token can not be used to guess it
+	checkCurrent := self && req.Password != nil && req.CurrentPassword != ""
+	var loginEmail string
+	if checkCurrent {
+		current, err := s.GetUserByID(userID)
 		if err != nil {
 			return nil, err
 		}
-		user.Password = string(hashedPassword)
+		loginEmail = current.Email
+		if err := s.checkLoginAllowed(loginEmail, client); err != nil {
+			return nil, err
+		}
 	}
 
-	if err := s.db.Save(&user).Error; err != nil {
+	var user models.User
+	var emailChanged bool
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		locked, err := lockUser(tx, userID)
+		if err != nil {
+			return err
+		}
+		user = *locked
+		previousRole := user.Role
+
+		updates := map[string]interface{}{}
+		var changed []string
+		if req.Username != nil && *req.Username != user.Username {
+			if err := checkUserUnique(tx, "username", *req.Username, user.ID); err != nil {
+				return err
+			}
+			updates["username"] = *req.Username
+			changed = append(changed, "username")
+		}
+		if req.Email != nil && *req.Email != user.Email {
+			if err := checkUserUnique(tx, "email", *req.Email, user.ID); err != nil {
+				return err
+			}
+			updates["email"] = *req.Email
+			updates["email_verified_at"] = nil
+			changed = append(changed, "email")
+			emailChanged = true
+
+			// Links mailed to the old address must not verify or reset the new one
+			err := invalidateUserTokens(tx, user.ID, time.Now(),
+				models.TokenPurposeEmailVerification, models.TokenPurposePasswordReset)
+			if err != nil {
+				return err
+			}
+		}
+		if req.Role != nil && *req.Role != user.Role {
+			updates["role"] = *req.Role
+			changed = append(changed, "role")
+		}
+		if len(updates) > 0 {
+			if err := tx.Model(&user).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+
+		if req.Password != nil {
+			if self {
+				if req.CurrentPassword == "" {
+					return ErrCurrentPasswordRequired
+				}
+				if ok, _ := s.verifyPassword(user.Password, req.CurrentPassword); !ok {
+					return ErrWrongCurrentPassword
+				}
+			}
+			if err := s.setPassword(tx, &user, *req.Password); err != nil {
+				return err
+			}
+			changed = append(changed, "password")
+		}
+
+		if len(changed) == 0 {
+			return nil
+		}
+		if req.Password != nil || updates["role"] != nil {
+			// Keep the session making the request when users change their own password
+			others := tx.Where("user_id = ?", user.ID)
+			if self && actor.SessionID != "" {
+				others = others.Where("id <> ?", actor.SessionID)
+			}
+			if err := revokeSessions(tx, others, time.Now()); err != nil {
+				return err
+			}
+		}
+		if role, ok := updates["role"]; ok {
+			err := recordAudit(tx, "user", user.ID, "role_changed", map[string]interface{}{
+				"from":       previousRole,
+				"to":         role,
+				"changed_by": actor.UserID,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return recordAudit(tx, "user", user.ID, "updated", map[string]interface{}{
+			"fields":     changed,
+			"updated_by": actor.UserID,
+		})
+	})
+	if checkCurrent {
+		if errors.Is(err, ErrWrongCurrentPassword) {
+			s.recordLoginFailure(userID, loginEmail, client, "wrong_current_password")
+		} else {
+			s.releaseLoginAttempt(loginEmail, client)
+		}
+	}
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
 		return nil, err
 	}
 
-	return &user, nil
+	if emailChanged {
+		s.sendWelcomeVerification(user.ID)
+	}
+	return s.GetUserByID(user.ID)
+}
+
+// Fail with ErrUserExists if another user, including a deleted one still
+// holding the unique index, has value in column
+func checkUserUnique(tx *gorm.DB, column, value string, userID uint) error {
+	var count int64
+	err := tx.Unscoped().Model(&models.User{}).
+		Where(column+" = ? AND id <> ?", value, userID).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("%w: %s is taken", ErrUserExists, column)
+	}
+	return nil
 }
 
 // Delete user
-func (s *AuthService) DeleteUser(userID uint) error {
+func (s *AuthService) DeleteUser(userID, deletedBy uint) error {
 	var user models.User
 	if err := s.db.First(&user, userID).Error; err != nil {
 		return err
 	}
 
-	if err := s.db.Delete(&user).Error; err != nil {
-		return err
-	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&user).Error; err != nil {
+			return err
+		}
 
-	return nil
+		// Nothing issued to the user may keep working until it expires
+		now := time.Now()
+		if err := revokeSessions(tx, tx.Where("user_id = ?", user.ID), now); err != nil {
+			return err
+		}
+		err := tx.Model(&models.APIKey{}).Where("user_id = ? AND revoked_at IS NULL", user.ID).Update("revoked_at", now).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&models.OAuthConsent{}).Where("user_id = ? AND revoked_at IS NULL", user.ID).Update("revoked_at", now).Error
+		if err != nil {
+			return err
+		}
+
+		return recordAudit(tx, "user", user.ID, "deleted", map[string]interface{}{
+			"username":   user.Username,
+			"email":      user.Email,
+			"deleted_by": deletedBy,
+		})
+	})
 }
@@ -9,66 +9,83 @@ import (
 	"gorm.io/gorm"
 )
 
+// Returned when a movement would take a balance below zero
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
 type BalanceService struct {
-	db *gorm.DB
+	db            *gorm.DB
+	ledgerService *LedgerService
+	lockMode      LockMode
+	maxRetries    int
 }
 
-func NewBalanceService(db *gorm.DB) *BalanceService {
-	return &BalanceService{db: db}
+func NewBalanceService(db *gorm.DB, ledgerService *LedgerService, lockMode LockMode, maxRetries int) *BalanceService {
+	return &BalanceService{
+		db:            db,
+		ledgerService: ledgerService,
+		lockMode:      lockMode,
+		maxRetries:    maxRetries,
+	}
 }
 
-// Get current balance for user
-func (s *BalanceService) GetBalance(userID uint) (*models.Balance, error) {
+// Get current balance of an account
+func (s *BalanceService) GetBalance(accountID uint) (*models.Balance, error) {
 	var balance models.Balance
-	if err := s.db.Where("user_id = ?", userID).First(&balance).Error; err != nil {
+	if err := s.db.Where("account_id = ?", accountID).First(&balance).Error; err != nil {
 		return nil, errors.New("balance not found")
 	}
 	return &balance, nil
 }
 
 // Update balance (thread-safe with database transaction)
-func (s *BalanceService) UpdateBalance(userID uint, amount float64) error {
-	return s.db.Transaction(func(tx *gorm.DB) error {
-		var balance models.Balance
-		if err := tx.Where("user_id = ?", userID).First(&balance).Error; err != nil {
+func (s *BalanceService) UpdateBalance(accountID uint, amount models.Money) error {
+	return s.runInTransaction(func(tx *gorm.DB) error {
+		account, err := loadActiveAccount(tx, accountID)
+		if err != nil {
 			return err
 		}
 
+		balances, err := s.lockBalances(tx, accountID)
+		if err != nil {
+			return err
+		}
+		balance, ok := balances[accountID]
+		if !ok {
+			return errors.New("balance not found")
+		}
+
 		// Check if sufficient funds for debit
-		if balance.Amount+amount < 0 {
-			return errors.New("insufficient funds")
+		if balance.Available()+amount < 0 {
+			return ErrInsufficientFunds
+		}
+
+		// Manual adjustments are offset against the cash system accounts
+		offset := models.SystemAccountCashIn
+		if amount < 0 {
+			offset = models.SystemAccountCashOut
+		}
+		if _, err := s.ledgerService.Post(tx, nil, "adjustment",
+			systemPosting(offset, account.Currency, -amount),
+			accountPosting(account, amount),
+		); err != nil {
+			return err
 		}
 
 		// Update balance
-		balance.Amount += amount
-		balance.LastUpdatedAt = time.Now()
+		if balance.Amount, err = balance.Amount.Add(amount); err != nil {
+			return err
+		}
 
-		return tx.Save(&balance).Error
+		return s.saveBalance(tx, balance)
 	})
 }
 
-// Get balance at specific time
-func (s *BalanceService) GetBalanceAtTime(userID uint, ts time.Time) (float64, error) {
-	var totalIncoming float64
-	var totalOutgoing float64
-
-	// Incoming: transactions where user is the receiver
-	err := s.db.Model(&models.Transaction{}).
-		Select("COALESCE(SUM(amount), 0)").
-		Where("to_user_id = ? AND created_at <= ?", userID, ts).
-		Scan(&totalIncoming).Error
-	if err != nil {
-		return 0, err
-	}
-
-	// Outgoing: transactions where user is the sender
-	err = s.db.Model(&models.Transaction{}).
-		Select("COALESCE(SUM(amount), 0)").
-		Where("from_user_id = ? AND created_at <= ?", userID, ts).
-		Scan(&totalOutgoing).Error
-	if err != nil {
-		return 0, err
-	}
+// Get balance of an account at specific time, derived from ledger postings
+func (s *BalanceService) GetBalanceAtTime(accountID uint, ts time.Time) (models.Money, error) {
+	return s.ledgerService.AccountBalanceAt(s.db, accountID, ts)
+}
 
-	return totalIncoming - totalOutgoing, nil
+// Check the stored balance of an account against the ledger
+func (s *BalanceService) VerifyBalance(accountID uint) (*BalanceVerification, error) {
+	return s.ledgerService.VerifyBalance(accountID)
 }
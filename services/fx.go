@@ -0,0 +1,192 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"bbank/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrUnsupportedCurrency = errors.New("unsupported currency")
+	ErrRateNotFound        = errors.New("no exchange rate for currency pair")
+	ErrCurrencyMismatch    = errors.New("currency does not match the account currency")
+)
+
+type FXService struct {
+	db     *gorm.DB
+	spread *big.Rat // fraction kept by the bank, e.g. 0.005
+}
+
+type RateInput struct {
+	BaseCurrency  string `json:"base_currency" binding:"required,len=3"`
+	QuoteCurrency string `json:"quote_currency" binding:"required,len=3"`
+	Rate          string `json:"rate" binding:"required"`
+}
+
+type SetRatesRequest struct {
+	Rates []RateInput `json:"rates" binding:"required,min=1,dive"`
+}
+
+// Result of converting an amount between two currencies
+type Conversion struct {
+	FromCurrency    string
+	ToCurrency      string
+	Amount          models.Money
+	ConvertedAmount models.Money
+	Rate            string // mid-market rate from FromCurrency to ToCurrency
+	Spread          string
+}
+
+func NewFXService(db *gorm.DB, spread string) (*FXService, error) {
+	r, ok := new(big.Rat).SetString(spread)
+	if !ok || r.Sign() < 0 || r.Cmp(big.NewRat(1, 1)) >= 0 {
+		return nil, fmt.Errorf("invalid FX spread %q", spread)
+	}
+	return &FXService{db: db, spread: r}, nil
+}
+
+// Load rates from a JSON file shaped like SetRatesRequest
+func (s *FXService) LoadRatesFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var req SetRatesRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	_, err = s.SetRates(req.Rates)
+	return err
+}
+
+// Insert or replace exchange rates
+func (s *FXService) SetRates(inputs []RateInput) ([]models.ExchangeRate, error) {
+	rates := make([]models.ExchangeRate, 0, len(inputs))
+	for _, in := range inputs {
+		base := models.NormalizeCurrency(in.BaseCurrency)
+		quote := models.NormalizeCurrency(in.QuoteCurrency)
+		if !models.IsSupportedCurrency(base) || !models.IsSupportedCurrency(quote) {
+			return nil, fmt.Errorf("%w: %s/%s", ErrUnsupportedCurrency, base, quote)
+		}
+		if base == quote {
+			return nil, fmt.Errorf("rate for %s/%s must use two different currencies", base, quote)
+		}
+
+		r, ok := new(big.Rat).SetString(in.Rate)
+		if !ok || r.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid rate %q for %s/%s", in.Rate, base, quote)
+		}
+
+		rates = append(rates, models.ExchangeRate{
+			BaseCurrency:  base,
+			QuoteCurrency: quote,
+			Rate:          r.FloatString(10),
+		})
+	}
+
+	err := s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "base_currency"}, {Name: "quote_currency"}},
+		DoUpdates: clause.AssignmentColumns([]string{"rate", "updated_at"}),
+	}).Create(&rates).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return rates, nil
+}
+
+// Get all known exchange rates
+func (s *FXService) GetRates() ([]models.ExchangeRate, error) {
+	var rates []models.ExchangeRate
+	if err := s.db.Order("base_currency, quote_currency").Find(&rates).Error; err != nil {
+		return nil, err
+	}
+	return rates, nil
+}
+
+// Convert amount from one currency to another at the current rate minus
+// the spread. Inverse rates are used when only the opposite pair is known.
+func (s *FXService) Convert(db *gorm.DB, from, to string, amount models.Money) (*Conversion, error) {
+	rate, err := s.lookupRate(db, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	// amount * rate * (1 - spread)
+	effective := new(big.Rat).Sub(big.NewRat(1, 1), s.spread)
+	effective.Mul(effective, rate)
+	converted := new(big.Rat).Mul(new(big.Rat).SetInt64(int64(amount)), effective)
+
+	return &Conversion{
+		FromCurrency:    from,
+		ToCurrency:      to,
+		Amount:          amount,
+		ConvertedAmount: models.Money(roundRat(converted)),
+		Rate:            rate.FloatString(10),
+		Spread:          s.spread.FloatString(6),
+	}, nil
+}
+
+// Value an amount in another currency at the mid-market rate, without the
+// spread
+func (s *FXService) Value(from, to string, amount models.Money) (models.Money, error) {
+	if from == to {
+		return amount, nil
+	}
+	rate, err := s.lookupRate(s.db, from, to)
+	if err != nil {
+		return 0, err
+	}
+	value := new(big.Rat).Mul(new(big.Rat).SetInt64(int64(amount)), rate)
+	return models.Money(roundRat(value)), nil
+}
+
+func (s *FXService) lookupRate(db *gorm.DB, from, to string) (*big.Rat, error) {
+	// Prefer the direct pair, fall back to the inverse of the opposite one
+	for _, pair := range [][2]string{{from, to}, {to, from}} {
+		var rate models.ExchangeRate
+		err := db.Where("base_currency = ? AND quote_currency = ?", pair[0], pair[1]).First(&rate).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		r, ok := new(big.Rat).SetString(rate.Rate)
+		if !ok || r.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid stored rate for %s/%s", rate.BaseCurrency, rate.QuoteCurrency)
+		}
+		if pair[0] != from {
+			r.Inv(r)
+		}
+		return r, nil
+	}
+
+	return nil, fmt.Errorf("%w %s/%s", ErrRateNotFound, from, to)
+}
+
+// Round to the nearest integer, halves away from zero
+func roundRat(r *big.Rat) int64 {
+	abs := new(big.Rat).Abs(r)
+	abs.Add(abs, big.NewRat(1, 2))
+	n := new(big.Int).Quo(abs.Num(), abs.Denom())
+	if r.Sign() < 0 {
+		n.Neg(n)
+	}
+	return n.Int64()
+}
+
+// Scale amount by num/den with the same rounding as conversions
+func scaleMoney(amount, num, den models.Money) models.Money {
+	product := new(big.Int).Mul(big.NewInt(int64(amount)), big.NewInt(int64(num)))
+	return models.Money(roundRat(new(big.Rat).SetFrac(product, big.NewInt(int64(den)))))
+}
@@ -0,0 +1,315 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"bbank/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrHoldNotFound       = errors.New("hold not found")
+	ErrHoldNotActive      = errors.New("hold is no longer active")
+	ErrHoldExpired        = errors.New("hold has expired")
+	ErrCaptureExceedsHold = errors.New("capture exceeds the held amount")
+)
+
+type HoldRequest struct {
+	Amount      models.Money `json:"amount" binding:"required,gt=0,lte=100000000000000"`
+	Currency    string       `json:"currency,omitempty" binding:"omitempty,len=3"` // must match the account
+	AccountID   *uint        `json:"account_id,omitempty"`                         // defaults to the user's default account
+	Description string       `json:"description"`
+}
+
+type CaptureRequest struct {
+	Amount *models.Money `json:"amount,omitempty"` // defaults to the full hold
+}
+
+// Reserve funds: available balance drops, ledger balance is unchanged
+func (s *TransactionService) CreateHold(userID, accountID uint, amount models.Money, currency, description string) (*models.Hold, error) {
+	var hold models.Hold
+
+	err := s.balanceService.runInTransaction(func(tx *gorm.DB) error {
+		account, err := loadOwnedAccount(tx, userID, accountID)
+		if err != nil {
+			return err
+		}
+		if err := checkCurrency(account, currency); err != nil {
+			return err
+		}
+
+		balances, err := s.balanceService.lockBalances(tx, accountID)
+		if err != nil {
+			return err
+		}
+		balance, ok := balances[accountID]
+		if !ok {
+			return errors.New("balance not found")
+		}
+
+		if balance.Available() < amount {
+			return ErrInsufficientFunds
+		}
+
+		if balance.HeldAmount, err = balance.HeldAmount.Add(amount); err != nil {
+			return err
+		}
+		if err := s.balanceService.saveBalance(tx, balance); err != nil {
+			return err
+		}
+
+		hold = models.Hold{
+			UserID:      userID,
+			AccountID:   accountID,
+			Amount:      amount,
+			Currency:    account.Currency,
+			Status:      models.HoldStatusActive,
+			Description: description,
+			ExpiresAt:   time.Now().Add(s.holdTTL),
+		}
+		if err := tx.Create(&hold).Error; err != nil {
+			return err
+		}
+		return auditHold(tx, &hold, "created")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &hold, nil
+}
+
+// Turn a hold into a debit of amount (zero captures the full hold). Any
+// uncaptured remainder is released.
+func (s *TransactionService) CaptureHold(holdID, userID uint, amount models.Money) (*models.Transaction, error) {
+	var transaction models.Transaction
+
+	err := s.balanceService.runInTransaction(func(tx *gorm.DB) error {
+		hold, err := lockActiveHold(tx, holdID, userID)
+		if err != nil {
+			return err
+		}
+		if time.Now().After(hold.ExpiresAt) {
+			return ErrHoldExpired
+		}
+
+		capture := amount
+		if capture == 0 {
+			capture = hold.Amount
+		}
+		if capture < 0 || capture > hold.Amount {
+			return ErrCaptureExceedsHold
+		}
+
+		account, err := loadActiveAccount(tx, hold.AccountID)
+		if err != nil {
+			return err
+		}
+
+		balances, err := s.balanceService.lockBalances(tx, hold.AccountID)
+		if err != nil {
+			return err
+		}
+		balance, ok := balances[hold.AccountID]
+		if !ok {
+			return errors.New("balance not found")
+		}
+
+		transaction = models.Transaction{
+			FromUserID:    &userID,
+			FromAccountID: &hold.AccountID,
+			Amount:        capture,
+			Currency:      account.Currency,
+			Type:          models.TransactionTypeDebit,
+			Status:        models.TransactionStatusCompleted,
+		}
+
+		if err := tx.Create(&transaction).Error; err != nil {
+			return err
+		}
+
+		if _, err := s.ledgerService.Post(tx, &transaction.ID, "hold capture",
+			accountPosting(account, -capture),
+			systemPosting(models.SystemAccountCashOut, account.Currency, capture),
+		); err != nil {
+			return err
+		}
+
+		// The whole reservation goes away, only the captured part is spent
+		if balance.HeldAmount, err = balance.HeldAmount.Sub(hold.Amount); err != nil {
+			return err
+		}
+		if balance.Amount, err = balance.Amount.Sub(capture); err != nil {
+			return err
+		}
+		if err := s.balanceService.saveBalance(tx, balance); err != nil {
+			return err
+		}
+
+		err = tx.Model(hold).Updates(map[string]interface{}{
+			"status":          models.HoldStatusCaptured,
+			"captured_amount": capture,
+			"transaction_id":  transaction.ID,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		if err := auditTransaction(tx, &transaction, "created"); err != nil {
+			return err
+		}
+		hold.Status = models.HoldStatusCaptured
+		return auditHold(tx, hold, "captured")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &transaction, nil
+}
+
+// Give the held funds back to the available balance
+func (s *TransactionService) ReleaseHold(holdID, userID uint) (*models.Hold, error) {
+	var hold *models.Hold
+
+	err := s.balanceService.runInTransaction(func(tx *gorm.DB) error {
+		var err error
+		hold, err = lockActiveHold(tx, holdID, userID)
+		if err != nil {
+			return err
+		}
+		return s.releaseHold(tx, hold, models.HoldStatusReleased)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hold, nil
+}
+
+// Get a hold owned by the user
+func (s *TransactionService) GetHold(holdID, userID uint) (*models.Hold, error) {
+	var hold models.Hold
+	if err := s.db.Where("id = ? AND user_id = ?", holdID, userID).First(&hold).Error; err != nil {
+		return nil, ErrHoldNotFound
+	}
+	return &hold, nil
+}
+
+// Get the active holds of a user
+func (s *TransactionService) GetActiveHolds(userID uint) ([]models.Hold, error) {
+	var holds []models.Hold
+	err := s.db.Where("user_id = ? AND status = ?", userID, models.HoldStatusActive).
+		Order("created_at DESC").
+		Find(&holds).Error
+	if err != nil {
+		return nil, err
+	}
+	return holds, nil
+}
+
+// Release every active hold whose TTL has passed
+func (s *TransactionService) ExpireHolds(now time.Time) (int, error) {
+	var ids []uint
+	err := s.db.Model(&models.Hold{}).
+		Where("status = ? AND expires_at <= ?", models.HoldStatusActive, now).
+		Pluck("id", &ids).Error
+	if err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, id := range ids {
+		err := s.balanceService.runInTransaction(func(tx *gorm.DB) error {
+			var hold models.Hold
+			err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				Where("id = ? AND status = ?", id, models.HoldStatusActive).
+				First(&hold).Error
+			if err != nil {
+				return err
+			}
+			return s.releaseHold(tx, &hold, models.HoldStatusExpired)
+		})
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue // captured or released in the meantime
+		}
+		if err != nil {
+			return expired, err
+		}
+		expired++
+	}
+
+	return expired, nil
+}
+
+// Periodically expire holds until ctx is cancelled
+func (s *TransactionService) RunHoldExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if n, err := s.ExpireHolds(now); err != nil {
+				log.Println("Failed to expire holds:", err)
+			} else if n > 0 {
+				log.Printf("Expired %d holds", n)
+			}
+		}
+	}
+}
+
+func lockActiveHold(tx *gorm.DB, holdID, userID uint) (*models.Hold, error) {
+	var hold models.Hold
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id = ? AND user_id = ?", holdID, userID).
+		First(&hold).Error
+	if err != nil {
+		return nil, ErrHoldNotFound
+	}
+	if hold.Status != models.HoldStatusActive {
+		return nil, ErrHoldNotActive
+	}
+	return &hold, nil
+}
+
+func (s *TransactionService) releaseHold(tx *gorm.DB, hold *models.Hold, status string) error {
+	balances, err := s.balanceService.lockBalances(tx, hold.AccountID)
+	if err != nil {
+		return err
+	}
+	balance, ok := balances[hold.AccountID]
+	if !ok {
+		return errors.New("balance not found")
+	}
+
+	if balance.HeldAmount, err = balance.HeldAmount.Sub(hold.Amount); err != nil {
+		return err
+	}
+	if err := s.balanceService.saveBalance(tx, balance); err != nil {
+		return err
+	}
+
+	hold.Status = status
+	if err := tx.Model(hold).Update("status", status).Error; err != nil {
+		return err
+	}
+	return auditHold(tx, hold, status)
+}
+
+// Record a change of a hold in the audit log; call it last in the transaction
+func auditHold(tx *gorm.DB, hold *models.Hold, action string) error {
+	return recordAudit(tx, "hold", hold.ID, action, map[string]interface{}{
+		"account_id": hold.AccountID,
+		"amount":     hold.Amount,
+		"currency":   hold.Currency,
+		"status":     hold.Status,
+	})
+}
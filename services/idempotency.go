@@ -0,0 +1,91 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"bbank/models"
+
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrIdempotencyKeyMismatch   = errors.New("idempotency key was already used with a different request")
+	ErrIdempotencyKeyInProgress = errors.New("a request with this idempotency key is still being processed")
+)
+
+const (
+	// How long a stored response can be replayed
+	idempotencyKeyTTL = 24 * time.Hour
+	// How long a reservation blocks retries if its request never completes,
+	// e.g. because the process died
+	idempotencyLease = 2 * time.Minute
+)
+
+type IdempotencyService struct {
+	db *gorm.DB
+}
+
+func NewIdempotencyService(db *gorm.DB) *IdempotencyService {
+	return &IdempotencyService{db: db}
+}
+
+// Reserve a key for a request. If the key was already completed with the
+// same request hash the stored record is returned with replay set to true.
+func (s *IdempotencyService) Begin(userID uint, key, requestHash string) (record *models.IdempotencyKey, replay bool, err error) {
+	now := time.Now()
+
+	// Forget expired keys and lapsed reservations so they can be reused
+	if err := s.db.Where("user_id = ? AND key = ? AND expires_at < ?", userID, key, now).
+		Delete(&models.IdempotencyKey{}).Error; err != nil {
+		return nil, false, err
+	}
+
+	record = &models.IdempotencyKey{
+		UserID:      userID,
+		Key:         key,
+		RequestHash: requestHash,
+		ExpiresAt:   now.Add(idempotencyLease),
+	}
+
+	result := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(record)
+	if result.Error != nil {
+		return nil, false, result.Error
+	}
+	if result.RowsAffected == 1 {
+		return record, false, nil
+	}
+
+	// Key already exists: replay, reject or report in-flight
+	var existing models.IdempotencyKey
+	if err := s.db.Where("user_id = ? AND key = ?", userID, key).First(&existing).Error; err != nil {
+		return nil, false, err
+	}
+
+	if existing.RequestHash != requestHash {
+		return nil, false, ErrIdempotencyKeyMismatch
+	}
+	if existing.CompletedAt == nil {
+		return nil, false, ErrIdempotencyKeyInProgress
+	}
+
+	return &existing, true, nil
+}
+
+// Store the response of the original request
+func (s *IdempotencyService) Complete(record *models.IdempotencyKey, statusCode int, response []byte) error {
+	now := time.Now()
+	return s.db.Model(record).Updates(map[string]interface{}{
+		"status_code":  statusCode,
+		"response":     datatypes.JSON(response),
+		"completed_at": now,
+		"expires_at":   now.Add(idempotencyKeyTTL),
+	}).Error
+}
+
+// Release a key whose request failed unexpectedly so it can be retried
+func (s *IdempotencyService) Abort(record *models.IdempotencyKey) error {
+	return s.db.Delete(record).Error
+}
@@ -0,0 +1,245 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// A key used to sign tokens, identified by the kid header
+type SigningKey struct {
+	ID         string
+	Method     jwt.SigningMethod // RS256 or EdDSA, derived from the key type
+	Private    crypto.Signer
+	ActiveFrom time.Time // tokens are signed with the newest active key
+}
+
+// Public key in JSON Web Key format
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`   // RSA modulus
+	E   string `json:"e,omitempty"`   // RSA exponent
+	Crv string `json:"crv,omitempty"` // OKP curve
+	X   string `json:"x,omitempty"`   // OKP public key
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// Holds the signing keys ordered by activation. A key keeps verifying tokens
+// for the overlap window after its successor becomes active, which must be
+// at least as long as the longest token lifetime.
+type KeyManager struct {
+	keys    []SigningKey
+	overlap time.Duration
+}
+
+// Parse key specs of the form "kid=path/to/key.pem[@2026-01-01T00:00:00Z]"
+// separated by commas, and load the PEM files. Without any spec an
+// ephemeral Ed25519 key is generated if allowEphemeral is set, which is
+// only fit for development.
+func NewKeyManager(specs string, overlap time.Duration, allowEphemeral bool) (*KeyManager, error) {
+	var keys []SigningKey
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		kid, rest, ok := strings.Cut(spec, "=")
+		if !ok || kid == "" {
+			return nil, fmt.Errorf("invalid signing key spec %q", spec)
+		}
+		path, from, hasFrom := strings.Cut(rest, "@")
+
+		key := SigningKey{ID: kid}
+		if hasFrom {
+			activeFrom, err := time.Parse(time.RFC3339, from)
+			if err != nil {
+				return nil, fmt.Errorf("invalid activation time for key %s: %w", kid, err)
+			}
+			key.ActiveFrom = activeFrom
+		}
+
+		signer, err := loadPrivateKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("load key %s: %w", kid, err)
+		}
+		if err := key.setSigner(signer); err != nil {
+			return nil, fmt.Errorf("load key %s: %w", kid, err)
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		if !allowEphemeral {
+			return nil, errors.New("no signing keys configured")
+		}
+		log.Println("No JWT signing keys configured, using an ephemeral key; tokens will not survive a restart")
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, SigningKey{ID: "ephemeral", Method: jwt.SigningMethodEdDSA, Private: private})
+	}
+
+	seen := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		if _, ok := seen[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate signing key id %s", key.ID)
+		}
+		seen[key.ID] = struct{}{}
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].ActiveFrom.Before(keys[j].ActiveFrom) })
+	if keys[0].ActiveFrom.After(time.Now()) {
+		return nil, errors.New("no signing key is active yet")
+	}
+
+	return &KeyManager{keys: keys, overlap: overlap}, nil
+}
+
+// Sign claims with the current key
+func (m *KeyManager) Sign(claims jwt.Claims) (string, error) {
+	key := m.current(time.Now())
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+// Parse a token and verify it with the key named by its kid header
+func (m *KeyManager) Parse(tokenString string) (*jwt.Token, error) {
+	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := m.verifying(kid, time.Now())
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, errors.New("signing method does not match the key")
+		}
+		return key.Private.Public(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}))
+}
+
+// Public keys that verify tokens now or will sign them later, so that
+// consumers can cache upcoming keys before they are used
+func (m *KeyManager) JWKS() JWKS {
+	now := time.Now()
+	set := JWKS{Keys: []JWK{}}
+	for i, key := range m.keys {
+		if m.retired(i, now) {
+			continue
+		}
+		set.Keys = append(set.Keys, key.jwk())
+	}
+	return set
+}
+
+// The newest key whose activation time has passed
+func (m *KeyManager) current(now time.Time) SigningKey {
+	current := m.keys[0]
+	for _, key := range m.keys[1:] {
+		if key.ActiveFrom.After(now) {
+			break
+		}
+		current = key
+	}
+	return current
+}
+
+func (m *KeyManager) verifying(kid string, now time.Time) (SigningKey, bool) {
+	for i, key := range m.keys {
+		if key.ID != kid {
+			continue
+		}
+		if key.ActiveFrom.After(now) || m.retired(i, now) {
+			return SigningKey{}, false
+		}
+		return key, true
+	}
+	return SigningKey{}, false
+}
+
+// A key is retired once the overlap window after its successor took over
+// has passed
+func (m *KeyManager) retired(i int, now time.Time) bool {
+	if i+1 >= len(m.keys) {
+		return false
+	}
+	return now.After(m.keys[i+1].ActiveFrom.Add(m.overlap))
+}
+
+func (k *SigningKey) setSigner(signer crypto.Signer) error {
+	switch signer.(type) {
+	case *rsa.PrivateKey:
+		k.Method = jwt.SigningMethodRS256
+	case ed25519.PrivateKey:
+		k.Method = jwt.SigningMethodEdDSA
+	default:
+		return fmt.Errorf("unsupported key type %T", signer)
+	}
+	k.Private = signer
+	return nil
+}
+
+func (k SigningKey) jwk() JWK {
+	jwk := JWK{Kid: k.ID, Use: "sig", Alg: k.Method.Alg()}
+	switch public := k.Private.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	}
+	return jwk
+}
+
+// Read an RSA (PKCS#1 or PKCS#8) or Ed25519 (PKCS#8) private key
+func loadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported key type %T", key)
+		}
+		return signer, nil
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
@@ -0,0 +1,129 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"bbank/models"
+
+	"gorm.io/gorm"
+)
+
+var ErrUnbalancedEntry = errors.New("journal entry does not balance")
+
+type LedgerService struct {
+	db *gorm.DB
+}
+
+// Result of comparing a stored balance with its ledger postings
+type BalanceVerification struct {
+	AccountID    uint         `json:"account_id"`
+	StoredAmount models.Money `json:"stored_amount"`
+	LedgerAmount models.Money `json:"ledger_amount"`
+	Balanced     bool         `json:"balanced"`
+	VerifiedAt   time.Time    `json:"verified_at"`
+}
+
+func NewLedgerService(db *gorm.DB) *LedgerService {
+	return &LedgerService{db: db}
+}
+
+// Posting against a customer account, in the account's currency
+func accountPosting(account *models.Account, amount models.Money) models.Posting {
+	accountID, userID := account.ID, account.UserID
+	return models.Posting{AccountID: &accountID, UserID: &userID, Amount: amount, Currency: account.Currency}
+}
+
+// Posting against one of the bank's system accounts
+func systemPosting(account, currency string, amount models.Money) models.Posting {
+	return models.Posting{SystemAccount: account, Amount: amount, Currency: currency}
+}
+
+// Write a journal entry inside the caller's database transaction. The
+// postings must balance within each currency.
+func (s *LedgerService) Post(tx *gorm.DB, transactionID *uint, description string, postings ...models.Posting) (*models.JournalEntry, error) {
+	if len(postings) < 2 {
+		return nil, ErrUnbalancedEntry
+	}
+
+	sums := make(map[string]models.Money)
+	for _, p := range postings {
+		if p.Amount == 0 || p.Currency == "" || (p.AccountID == nil) == (p.SystemAccount == "") {
+			return nil, fmt.Errorf("%w: invalid posting", ErrUnbalancedEntry)
+		}
+		sums[p.Currency] += p.Amount
+	}
+	for currency, sum := range sums {
+		if sum != 0 {
+			return nil, fmt.Errorf("%w in %s", ErrUnbalancedEntry, currency)
+		}
+	}
+
+	now := time.Now()
+	for i := range postings {
+		postings[i].CreatedAt = now
+	}
+
+	entry := models.JournalEntry{
+		TransactionID: transactionID,
+		Description:   description,
+		CreatedAt:     now,
+		Postings:      postings,
+	}
+
+	if err := tx.Create(&entry).Error; err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// Sum of an account's postings up to the given time
+func (s *LedgerService) AccountBalanceAt(db *gorm.DB, accountID uint, ts time.Time) (models.Money, error) {
+	var total models.Money
+	err := db.Model(&models.Posting{}).
+		Select("COALESCE(SUM(amount), 0)").
+		Where("account_id = ? AND created_at <= ?", accountID, ts).
+		Scan(&total).Error
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// Compare the stored balance of an account with the sum of its postings
+func (s *LedgerService) VerifyBalance(accountID uint) (*BalanceVerification, error) {
+	var result BalanceVerification
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var balance models.Balance
+		if err := tx.Where("account_id = ?", accountID).First(&balance).Error; err != nil {
+			return errors.New("balance not found")
+		}
+
+		var ledgerAmount models.Money
+		err := tx.Model(&models.Posting{}).
+			Select("COALESCE(SUM(amount), 0)").
+			Where("account_id = ?", accountID).
+			Scan(&ledgerAmount).Error
+		if err != nil {
+			return err
+		}
+
+		result = BalanceVerification{
+			AccountID:    accountID,
+			StoredAmount: balance.Amount,
+			LedgerAmount: ledgerAmount,
+			Balanced:     balance.Amount == ledgerAmount,
+			VerifiedAt:   time.Now(),
+		}
+		return nil
+	}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
@@ -0,0 +1,101 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"bbank/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// How balance rows are protected against concurrent updates
+type LockMode string
+
+const (
+	// SELECT ... FOR UPDATE, writers to the same balance are serialized
+	LockModePessimistic LockMode = "pessimistic"
+	// Version check on save, conflicting transactions are retried
+	LockModeOptimistic LockMode = "optimistic"
+)
+
+var (
+	errVersionConflict = errors.New("balance was modified concurrently")
+
+	// Returned when an optimistic update keeps conflicting
+	ErrBalanceConflict = errors.New("balance is busy, retries exhausted")
+)
+
+func ParseLockMode(s string) (LockMode, error) {
+	switch mode := LockMode(s); mode {
+	case LockModePessimistic, LockModeOptimistic:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown balance lock mode %q", s)
+}
+
+// Load the balance rows of the given accounts. Rows are always read in
+// ascending account ID order; in pessimistic mode they are locked with
+// SELECT ... FOR UPDATE and Postgres acquires the locks in ORDER BY order,
+// so concurrent transfers cannot deadlock. Accounts without a balance row
+// are missing from the returned map.
+func (s *BalanceService) lockBalances(tx *gorm.DB, accountIDs ...uint) (map[uint]*models.Balance, error) {
+	query := tx.Where("account_id IN ?", accountIDs).Order("account_id ASC")
+	if s.lockMode == LockModePessimistic {
+		query = query.Clauses(clause.Locking{Strength: "UPDATE"})
+	}
+
+	var rows []models.Balance
+	if err := query.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	balances := make(map[uint]*models.Balance, len(rows))
+	for i := range rows {
+		balances[rows[i].AccountID] = &rows[i]
+	}
+	return balances, nil
+}
+
+// Write a balance back only if nobody changed it since it was loaded
+func (s *BalanceService) saveBalance(tx *gorm.DB, balance *models.Balance) error {
+	balance.LastUpdatedAt = time.Now()
+
+	result := tx.Model(&models.Balance{}).
+		Where("account_id = ? AND version = ?", balance.AccountID, balance.Version).
+		Updates(map[string]interface{}{
+			"amount":          balance.Amount,
+			"held_amount":     balance.HeldAmount,
+			"last_updated_at": balance.LastUpdatedAt,
+			"version":         balance.Version + 1,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errVersionConflict
+	}
+
+	balance.Version++
+	return nil
+}
+
+// Run fn in a database transaction, retrying it when a balance version
+// conflict is detected
+func (s *BalanceService) runInTransaction(fn func(tx *gorm.DB) error) error {
+	for attempt := 0; ; attempt++ {
+		err := s.db.Transaction(fn)
+		if !errors.Is(err, errVersionConflict) {
+			return err
+		}
+		if attempt >= s.maxRetries {
+			return fmt.Errorf("%w after %d attempts", ErrBalanceConflict, attempt+1)
+		}
+
+		// Randomized backoff so competing writers spread out
+		time.Sleep(time.Duration(rand.IntN(5*(attempt+1))+1) * time.Millisecond)
+	}
+}
@@ -0,0 +1,188 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"bbank/config"
+	"bbank/models"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const (
+	stressWorkers    = 16
+	stressOperations = 40
+	stressOpening    = models.Money(10_000)
+)
+
+// Open the database named by TEST_DATABASE_URL, skipping the test when it
+// is not set. The schema is migrated as on startup, with a partitioned
+// audit log; rows are left behind, so point it at a throwaway database.
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("test database is not available: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlDB.Ping(); err != nil {
+		t.Fatalf("test database is not available: %v", err)
+	}
+	sqlDB.SetMaxOpenConns(stressWorkers + 4)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	if err := config.Migrate(db, &config.Config{DefaultCurrency: "USD"}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// Hammer two accounts with transfers in both directions and debits from
+// several goroutines and check that no balance goes negative, the money
+// that left matches the debits and the balances match the ledger
+func TestConcurrentMovementsKeepBalances(t *testing.T) {
+	db := openTestDB(t)
+
+	for _, mode := range []LockMode{LockModePessimistic, LockModeOptimistic} {
+		t.Run(string(mode), func(t *testing.T) {
+			ledgerService := NewLedgerService(db)
+			balanceService := NewBalanceService(db, ledgerService, mode, 100)
+			fxService, err := NewFXService(db, "0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			transactionService := NewTransactionService(db, balanceService, ledgerService, fxService, time.Hour)
+			accountService := NewAccountService(db, "USD")
+
+			var userIDs, accountIDs [2]uint
+			for i := range userIDs {
+				userIDs[i], accountIDs[i] = createStressAccount(t, db, accountService, fmt.Sprintf("%s-%d", mode, i))
+				if _, err := transactionService.Credit(userIDs[i], accountIDs[i], stressOpening, ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			stop := make(chan struct{})
+			watched := make(chan error, 1)
+			go func() { watched <- watchBalances(db, accountIDs[:], stop) }()
+
+			var (
+				wg      sync.WaitGroup
+				mu      sync.Mutex
+				debited models.Money
+				failed  error
+			)
+			for w := 0; w < stressWorkers; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for op := 0; op < stressOperations; op++ {
+						from := rand.IntN(2)
+						amount := models.Money(rand.IntN(3000) + 1)
+
+						var err error
+						if rand.IntN(3) == 0 {
+							_, err = transactionService.Debit(userIDs[from], accountIDs[from], amount, "")
+							if err == nil {
+								mu.Lock()
+								debited += amount
+								mu.Unlock()
+							}
+						} else {
+							_, err = transactionService.Transfer(userIDs[from], accountIDs[from], accountIDs[1-from], amount, "")
+						}
+						if err != nil && !errors.Is(err, ErrInsufficientFunds) && !errors.Is(err, ErrBalanceConflict) {
+							mu.Lock()
+							failed = err
+							mu.Unlock()
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			close(stop)
+
+			if failed != nil {
+				t.Fatalf("unexpected error: %v", failed)
+			}
+			if err := <-watched; err != nil {
+				t.Fatal(err)
+			}
+
+			var total models.Money
+			for _, accountID := range accountIDs {
+				balance, err := balanceService.GetBalance(accountID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if balance.Amount < 0 {
+					t.Errorf("account %d ended at %d", accountID, balance.Amount)
+				}
+				total += balance.Amount
+
+				verification, err := balanceService.VerifyBalance(accountID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !verification.Balanced {
+					t.Errorf("account %d stores %d but the ledger has %d", accountID, verification.StoredAmount, verification.LedgerAmount)
+				}
+			}
+			if want := 2*stressOpening - debited; total != want {
+				t.Errorf("balances sum to %d, want %d", total, want)
+			}
+		})
+	}
+}
+
+// Create a user with one account and return both IDs
+func createStressAccount(t *testing.T, db *gorm.DB, accountService *AccountService, name string) (uint, uint) {
+	t.Helper()
+	suffix := fmt.Sprintf("%s-%d", name, time.Now().UnixNano())
+	user := models.User{Username: "stress-" + suffix, Email: "stress-" + suffix + "@example.com", Password: "x"}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	account, err := accountService.CreateAccount(user.ID, CreateAccountRequest{Name: "Stress", Currency: "USD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user.ID, account.ID
+}
+
+// Poll the balances until stop is closed and report the first negative one
+func watchBalances(db *gorm.DB, accountIDs []uint, stop <-chan struct{}) error {
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(time.Millisecond):
+		}
+
+		var balances []models.Balance
+		if err := db.Where("account_id IN ?", accountIDs).Find(&balances).Error; err != nil {
+			return err
+		}
+		for _, balance := range balances {
+			if balance.Amount < 0 {
+				return fmt.Errorf("account %d went down to %d", balance.AccountID, balance.Amount)
+			}
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"bbank/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrInvalidCredentials = errors.New("invalid email or password")
+
+// Limits on failed logins. Failures older than Lockout are forgotten.
+type LoginPolicy struct {
+	MaxAccountFailures int           // failures before the account is locked
+	MaxIPFailures      int           // failures before the client IP is locked
+	Lockout            time.Duration // how long a lock lasts
+	BaseDelay          time.Duration // wait after the first failure, doubled after each further one
+	MaxDelay           time.Duration
+}
+
+// Returned while an account or IP must wait before trying again
+type LoginBlockedError struct {
+	Locked bool // locked out rather than just slowed down
+	Until  time.Time
+}
+
+func (e *LoginBlockedError) Error() string {
+	if e.Locked {
+		return "too many failed logins, try again later"
+	}
+	return fmt.Sprintf("too many failed logins, retry in %s", time.Until(e.Until).Round(time.Second))
+}
+
+// Lift a lockout of the user's account
+func (s *AuthService) UnlockUser(userID, adminID uint) error {
+	user, err := s.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("scope = ? AND key = ?", models.LoginScopeAccount, loginKey(user.Email)).
+			Delete(&models.LoginThrottle{}).Error
+		if err != nil {
+			return err
+		}
+		return recordAudit(tx, "user", user.ID, "login_unlocked", map[string]interface{}{
+			"unlocked_by": adminID,
+		})
+	})
+}
+
+// Count an attempt at the account's credentials against the account and
+// the client IP before they are checked, refusing it while either is
+// throttled. Counting first makes parallel guesses wait out the delay like
+// sequential ones. Valid attempts are taken back by releaseLoginAttempt.
+func (s *AuthService) checkLoginAllowed(email string, client ClientInfo) error {
+	scopes := s.loginScopes(email, client)
+	now := time.Now()
+
+	var blocked *LoginBlockedError
+	var locked []string
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// Rows are locked in scope order, so concurrent attempts can't deadlock
+		throttles := make([]models.LoginThrottle, len(scopes))
+		for i, sc := range scopes {
+			throttle := models.LoginThrottle{Scope: sc.scope, Key: sc.key}
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&throttle).Error; err != nil {
+				return err
+			}
+			err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				Where("scope = ? AND key = ?", sc.scope, sc.key).
+				First(&throttles[i]).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		blocked, locked = nil, nil
+		for i := range throttles {
+			t := &throttles[i]
+			if t.LockedUntil != nil && now.Before(*t.LockedUntil) {
+				blocked = &LoginBlockedError{Locked: true, Until: *t.LockedUntil}
+				continue
+			}
+			if now.Sub(t.LastFailureAt) > s.loginPolicy.Lockout {
+				t.Failures = 0 // stale failures
+			}
+			if max := scopes[i].max; max > 0 && t.Failures >= max {
+				// Start over after the lock so the next attempt is not locked at once
+				until := now.Add(s.loginPolicy.Lockout)
+				err := tx.Model(t).Updates(map[string]interface{}{"locked_until": until, "failures": 0}).Error
+				if err != nil {
+					return err
+				}
+				blocked = &LoginBlockedError{Locked: true, Until: until}
+				locked = append(locked, t.Scope)
+				continue
+			}
+			if until := t.LastFailureAt.Add(s.loginPolicy.delay(t.Failures)); now.Before(until) && blocked == nil {
+				blocked = &LoginBlockedError{Until: until}
+			}
+		}
+		if blocked != nil {
+			return nil
+		}
+
+		for i := range throttles {
+			err := tx.Model(&throttles[i]).Updates(map[string]interface{}{
+				"failures":        throttles[i].Failures + 1,
+				"last_failure_at": now,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// One entry per lock rather than per refused attempt
+	for _, scope := range locked {
+		s.auditLogin(0, "login_blocked", email, client, map[string]interface{}{"scope": scope, "until": blocked.Until})
+	}
+	if blocked != nil {
+		return blocked
+	}
+	return nil
+}
+
+// Record a failed attempt; it was already counted by checkLoginAllowed
+func (s *AuthService) recordLoginFailure(userID uint, email string, client ClientInfo, reason string) {
+	s.auditLogin(userID, "login_failed", email, client, map[string]interface{}{"reason": reason})
+}
+
+// Take back an attempt counted by checkLoginAllowed that was not a wrong
+// guess, such as a correct password still waiting for its second factor
+func (s *AuthService) releaseLoginAttempt(email string, client ClientInfo) {
+	for _, sc := range s.loginScopes(email, client) {
+		err := s.db.Model(&models.LoginThrottle{}).
+			Where("scope = ? AND key = ? AND failures > 0", sc.scope, sc.key).
+			Update("failures", gorm.Expr("failures - 1")).Error
+		if err != nil {
+			log.Printf("Failed to release login attempt of %s %s: %v", sc.scope, sc.key, err)
+		}
+	}
+}
+
+// Forget the failures of the account after a successful login. Failures
+// of the IP are kept, so one valid account can not reset them.
+func (s *AuthService) recordLoginSuccess(user *models.User, client ClientInfo) {
+	s.releaseLoginAttempt(user.Email, client)
+	err := s.db.Where("scope = ? AND key = ?", models.LoginScopeAccount, loginKey(user.Email)).
+		Delete(&models.LoginThrottle{}).Error
+	if err != nil {
+		log.Printf("Failed to reset login failures of user %d: %v", user.ID, err)
+	}
+	s.auditLogin(user.ID, "login_succeeded", user.Email, client, nil)
+}
+
+type loginScope struct {
+	scope, key string
+	max        int
+}
+
+// Throttles an attempt counts against, in locking order
+func (s *AuthService) loginScopes(email string, client ClientInfo) []loginScope {
+	scopes := []loginScope{{models.LoginScopeAccount, loginKey(email), s.loginPolicy.MaxAccountFailures}}
+	if client.IPAddress != "" {
+		scopes = append(scopes, loginScope{models.LoginScopeIP, client.IPAddress, s.loginPolicy.MaxIPFailures})
+	}
+	return scopes
+}
+
+// Delete throttles whose failures and lock have run out. Every email and
+// IP that was ever tried gets one, so they would otherwise pile up.
+func (s *AuthService) PurgeLoginThrottles(now time.Time) (int64, error) {
+	result := s.db.
+		Where("last_failure_at < ? AND (locked_until IS NULL OR locked_until < ?)", now.Add(-s.loginPolicy.Lockout), now).
+		Delete(&models.LoginThrottle{})
+	return result.RowsAffected, result.Error
+}
+
+// Purge expired login throttles every interval until ctx is done
+func (s *AuthService) RunThrottlePurge(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if n, err := s.PurgeLoginThrottles(now); err != nil {
+				log.Println("Failed to purge login throttles:", err)
+			} else if n > 0 {
+				log.Printf("Purged %d login throttles", n)
+			}
+		}
+	}
+}
+
+// Login events go through the audit writer under their own entity type,
+// so a flood of failed logins does not hold up writers of the user chain
+func (s *AuthService) auditLogin(userID uint, action, email string, client ClientInfo, extra map[string]interface{}) {
+	details := map[string]interface{}{
+		"email":      email,
+		"ip_address": client.IPAddress,
+		"user_agent": client.UserAgent,
+	}
+	for k, v := range extra {
+		details[k] = v
+	}
+	s.auditWriter.Write("login", userID, action, details)
+}
+
+// Wait required after the given number of consecutive failures
+func (p LoginPolicy) delay(failures int) time.Duration {
+	if failures <= 0 || p.BaseDelay <= 0 {
+		return 0
+	}
+	d := p.BaseDelay
+	for i := 1; i < failures && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+func loginKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,573 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"bbank/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrOAuthClientNotFound  = errors.New("oauth client not found")
+	ErrOAuthConsentNotFound = errors.New("oauth consent not found")
+)
+
+const (
+	oauthClientTag      = "bbc"
+	oauthCodeTTL        = 5 * time.Minute
+	oauthAccessTokenTTL = time.Hour
+)
+
+// PKCE verifiers and S256 challenges (RFC 7636)
+var (
+	pkceVerifierPattern  = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+	pkceChallengePattern = regexp.MustCompile(`^[A-Za-z0-9\-_]{43}$`)
+)
+
+// Error reported to OAuth clients in the format of RFC 6749 section 5.2
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *OAuthError) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+// HTTP status for the error; failed client authentication is 401
+func (e *OAuthError) Status() int {
+	if e.Code == "invalid_client" {
+		return http.StatusUnauthorized
+	}
+	return http.StatusBadRequest
+}
+
+func oauthError(code, description string) *OAuthError {
+	return &OAuthError{Code: code, Description: description}
+}
+
+type RegisterOAuthClientRequest struct {
+	Name         string   `json:"name" binding:"required"`
+	RedirectURIs []string `json:"redirect_uris"`
+	Scopes       []string `json:"scopes" binding:"required,min=1"`
+	Confidential bool     `json:"confidential"`
+}
+
+// Returned once on registration, the only time the secret is visible
+type RegisteredOAuthClient struct {
+	ClientSecret string             `json:"client_secret,omitempty"`
+	Client       models.OAuthClient `json:"client"`
+}
+
+// Parameters of an authorization request, read from the query string when
+// showing the consent screen and from the body when the user decides
+type AuthorizeRequest struct {
+	ResponseType        string `form:"response_type" json:"response_type" binding:"required"`
+	ClientID            string `form:"client_id" json:"client_id" binding:"required"`
+	RedirectURI         string `form:"redirect_uri" json:"redirect_uri" binding:"required"`
+	Scope               string `form:"scope" json:"scope"`
+	State               string `form:"state" json:"state"`
+	CodeChallenge       string `form:"code_challenge" json:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method" json:"code_challenge_method"`
+	Approve             bool   `form:"-" json:"approve"`
+}
+
+// What the consent screen shows the user
+type AuthorizationPrompt struct {
+	Client          models.OAuthClient `json:"client"`
+	Scopes          []string           `json:"scopes"`
+	AlreadyApproved bool               `json:"already_approved"`
+}
+
+// Token endpoint parameters (RFC 6749 sections 4.1.3 and 4.4.2)
+type OAuthTokenRequest struct {
+	GrantType    string `form:"grant_type" binding:"required"`
+	Code         string `form:"code"`
+	RedirectURI  string `form:"redirect_uri"`
+	CodeVerifier string `form:"code_verifier"`
+	Scope        string `form:"scope"`
+	ClientID     string `form:"client_id"`
+	ClientSecret string `form:"client_secret"`
+}
+
+type OAuthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope"`
+}
+
+// Register a third-party application. Public clients get no secret and can
+// only use the authorization code flow.
+func (s *AuthService) RegisterOAuthClient(adminID uint, req RegisterOAuthClientRequest) (*RegisteredOAuthClient, error) {
+	for _, scope := range req.Scopes {
+		switch {
+		case containsScope(models.OAuthUserScopes, scope):
+			if len(req.RedirectURIs) == 0 {
+				return nil, fmt.Errorf("scope %q needs at least one redirect URI", scope)
+			}
+		case containsScope(models.OAuthClientScopes, scope):
+			if !req.Confidential {
+				return nil, fmt.Errorf("scope %q is only available to confidential clients", scope)
+			}
+		default:
+			return nil, fmt.Errorf("scope %q can not be granted to third-party apps", scope)
+		}
+	}
+	for _, redirectURI := range req.RedirectURIs {
+		if err := checkRedirectURI(redirectURI); err != nil {
+			return nil, err
+		}
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	client := models.OAuthClient{
+		ClientID:     oauthClientTag + "_" + hex.EncodeToString(id),
+		Name:         req.Name,
+		Confidential: req.Confidential,
+		RedirectURIs: req.RedirectURIs,
+		Scopes:       req.Scopes,
+		CreatedBy:    adminID,
+	}
+	if client.RedirectURIs == nil {
+		client.RedirectURIs = []string{}
+	}
+
+	var secret string
+	if req.Confidential {
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		secret = base64.RawURLEncoding.EncodeToString(raw)
+		client.SecretHash = hashToken(secret)
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&client).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, "oauth_client", client.ID, "created", map[string]interface{}{
+			"client_id":    client.ClientID,
+			"scopes":       client.Scopes,
+			"confidential": client.Confidential,
+			"created_by":   adminID,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &RegisteredOAuthClient{ClientSecret: secret, Client: client}, nil
+}
+
+// Get all registered clients, including revoked ones
+func (s *AuthService) GetOAuthClients() ([]models.OAuthClient, error) {
+	var clients []models.OAuthClient
+	if err := s.db.Order("created_at DESC").Find(&clients).Error; err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+// Revoke a client. Its tokens stop working at once.
+func (s *AuthService) RevokeOAuthClient(adminID, id uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.OAuthClient{}).
+			Where("id = ? AND revoked_at IS NULL", id).
+			Update("revoked_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrOAuthClientNotFound
+		}
+		return recordAudit(tx, "oauth_client", id, "revoked", map[string]interface{}{"revoked_by": adminID})
+	})
+}
+
+// Check an authorization request and describe it for the consent screen.
+// Errors here must be shown to the user, not sent to the redirect URI.
+func (s *AuthService) PrepareAuthorization(userID uint, req AuthorizeRequest) (*AuthorizationPrompt, error) {
+	client, scopes, err := s.checkAuthorizeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	prompt := &AuthorizationPrompt{Client: *client, Scopes: scopes}
+	var consent models.OAuthConsent
+	err = s.db.Where("user_id = ? AND client_id = ? AND revoked_at IS NULL", userID, client.ClientID).First(&consent).Error
+	if err == nil {
+		prompt.AlreadyApproved = scopesCovered(consent.Scopes, scopes)
+	}
+	return prompt, nil
+}
+
+// Record the user's decision and return the URI to send them back to. An
+// approval stores the consent and adds a single-use code to the URI.
+func (s *AuthService) Authorize(userID uint, req AuthorizeRequest) (string, error) {
+	client, scopes, err := s.checkAuthorizeRequest(req)
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	if !req.Approve {
+		params.Set("error", "access_denied")
+		return appendQuery(req.RedirectURI, params), nil
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	code := base64.RawURLEncoding.EncodeToString(raw)
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		consent := models.OAuthConsent{UserID: userID, ClientID: client.ClientID, Scopes: scopes}
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "user_id"}, {Name: "client_id"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{"scopes": consent.Scopes, "revoked_at": nil, "updated_at": time.Now()}),
+		}).Create(&consent).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Create(&models.OAuthAuthorizationCode{
+			CodeHash:      hashToken(code),
+			ClientID:      client.ClientID,
+			UserID:        userID,
+			RedirectURI:   req.RedirectURI,
+			Scopes:        scopes,
+			CodeChallenge: req.CodeChallenge,
+			ExpiresAt:     time.Now().Add(oauthCodeTTL),
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		return recordAudit(tx, "user", userID, "oauth_consent_granted", map[string]interface{}{
+			"client_id": client.ClientID,
+			"scopes":    scopes,
+		})
+	})
+	if err != nil {
+		return "", err
+	}
+
+	params.Set("code", code)
+	return appendQuery(req.RedirectURI, params), nil
+}
+
+// Issue an access token at the token endpoint
+func (s *AuthService) ExchangeOAuthToken(req OAuthTokenRequest) (*OAuthTokenResponse, error) {
+	client, err := s.authenticateOAuthClient(req.ClientID, req.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	switch req.GrantType {
+	case "authorization_code":
+		return s.exchangeAuthorizationCode(client, req)
+	case "client_credentials":
+		return s.exchangeClientCredentials(client, req)
+	}
+	return nil, oauthError("unsupported_grant_type", "")
+}
+
+// Get the apps the user has approved
+func (s *AuthService) GetOAuthConsents(userID uint) ([]models.OAuthConsent, error) {
+	var consents []models.OAuthConsent
+	err := s.db.Preload("Client").
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Order("updated_at DESC").
+		Find(&consents).Error
+	if err != nil {
+		return nil, err
+	}
+	return consents, nil
+}
+
+// Withdraw the user's approval of an app, ending its access at once
+func (s *AuthService) RevokeOAuthConsent(userID, consentID uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var consent models.OAuthConsent
+		if err := tx.Where("id = ? AND user_id = ? AND revoked_at IS NULL", consentID, userID).First(&consent).Error; err != nil {
+			return ErrOAuthConsentNotFound
+		}
+		if err := tx.Model(&consent).Update("revoked_at", time.Now()).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, "user", userID, "oauth_consent_revoked", map[string]interface{}{
+			"client_id": consent.ClientID,
+		})
+	})
+}
+
+func (s *AuthService) checkAuthorizeRequest(req AuthorizeRequest) (*models.OAuthClient, []string, error) {
+	var client models.OAuthClient
+	if err := s.db.Where("client_id = ? AND revoked_at IS NULL", req.ClientID).First(&client).Error; err != nil {
+		return nil, nil, ErrOAuthClientNotFound
+	}
+	if !containsScope(client.RedirectURIs, req.RedirectURI) {
+		return nil, nil, errors.New("redirect_uri is not registered for this client")
+	}
+	if req.ResponseType != "code" {
+		return nil, nil, errors.New("response_type must be code")
+	}
+	// PKCE is required of every client, confidential or not
+	if req.CodeChallengeMethod != "S256" || !pkceChallengePattern.MatchString(req.CodeChallenge) {
+		return nil, nil, errors.New("an S256 code_challenge is required")
+	}
+
+	scopes, err := grantScopes(client.Scopes, models.OAuthUserScopes, req.Scope)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &client, scopes, nil
+}
+
+// Identify the client at the token endpoint. Confidential clients must
+// present their secret.
+func (s *AuthService) authenticateOAuthClient(clientID, secret string) (*models.OAuthClient, error) {
+	if clientID == "" {
+		return nil, oauthError("invalid_client", "client authentication is required")
+	}
+
+	var client models.OAuthClient
+	if err := s.db.Where("client_id = ?", clientID).First(&client).Error; err != nil || client.RevokedAt != nil {
+		return nil, oauthError("invalid_client", "")
+	}
+	if client.Confidential && subtle.ConstantTimeCompare([]byte(client.SecretHash), []byte(hashToken(secret))) != 1 {
+		return nil, oauthError("invalid_client", "")
+	}
+	return &client, nil
+}
+
+func (s *AuthService) exchangeAuthorizationCode(client *models.OAuthClient, req OAuthTokenRequest) (*OAuthTokenResponse, error) {
+	if req.Code == "" || req.RedirectURI == "" || req.CodeVerifier == "" {
+		return nil, oauthError("invalid_request", "code, redirect_uri and code_verifier are required")
+	}
+	if !pkceVerifierPattern.MatchString(req.CodeVerifier) {
+		return nil, oauthError("invalid_request", "malformed code_verifier")
+	}
+
+	var response *OAuthTokenResponse
+	var reused bool
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var code models.OAuthAuthorizationCode
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("code_hash = ?", hashToken(req.Code)).
+			First(&code).Error
+		if err != nil || code.ClientID != client.ClientID {
+			return oauthError("invalid_grant", "")
+		}
+
+		now := time.Now()
+		if code.UsedAt != nil {
+			// A code presented twice may have been stolen, so withdraw
+			// the consent it was issued under (RFC 6749 section 4.1.2)
+			reused = true
+			return tx.Model(&models.OAuthConsent{}).
+				Where("user_id = ? AND client_id = ? AND revoked_at IS NULL", code.UserID, code.ClientID).
+				Update("revoked_at", now).Error
+		}
+		if now.After(code.ExpiresAt) || code.RedirectURI != req.RedirectURI {
+			return oauthError("invalid_grant", "")
+		}
+		digest := sha256.Sum256([]byte(req.CodeVerifier))
+		if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(digest[:])), []byte(code.CodeChallenge)) != 1 {
+			return oauthError("invalid_grant", "code_verifier does not match the code_challenge")
+		}
+		if err := tx.Model(&code).Update("used_at", now).Error; err != nil {
+			return err
+		}
+
+		var user models.User
+		if err := tx.First(&user, code.UserID).Error; err != nil {
+			return oauthError("invalid_grant", "")
+		}
+		response, err = s.signOAuthToken(user.ID, user.Role, client.ClientID, code.Scopes)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reused {
+		return nil, oauthError("invalid_grant", "authorization code was already used")
+	}
+	return response, nil
+}
+
+func (s *AuthService) exchangeClientCredentials(client *models.OAuthClient, req OAuthTokenRequest) (*OAuthTokenResponse, error) {
+	if !client.Confidential {
+		return nil, oauthError("unauthorized_client", "public clients can not use client_credentials")
+	}
+	scopes, err := grantScopes(client.Scopes, models.OAuthClientScopes, req.Scope)
+	if err != nil {
+		return nil, oauthError("invalid_scope", err.Error())
+	}
+	return s.signOAuthToken(0, models.RoleUser, client.ClientID, scopes)
+}
+
+// Sign a delegated access token. Client credentials tokens have no user.
+func (s *AuthService) signOAuthToken(userID uint, role, clientID string, scopes []string) (*OAuthTokenResponse, error) {
+	scope := strings.Join(scopes, " ")
+	token, err := s.keys.Sign(jwt.MapClaims{
+		"user_id":   userID,
+		"role":      role,
+		"client_id": clientID,
+		"scope":     scope,
+		"jti":       uuid.NewString(),
+		"exp":       time.Now().Add(oauthAccessTokenTTL).Unix(),
+		"iat":       time.Now().Unix(),
+		"type":      "oauth_access",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &OAuthTokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(oauthAccessTokenTTL.Seconds()),
+		Scope:       scope,
+	}, nil
+}
+
+// Check the claims of a delegated token against the current state of its
+// client and of the user's consent
+func (s *AuthService) validateOAuthClaims(claims jwt.MapClaims) (*AccessClaims, error) {
+	userID, ok := claims["user_id"].(float64)
+	clientID, _ := claims["client_id"].(string)
+	if !ok || clientID == "" {
+		return nil, errors.New("invalid access token")
+	}
+	scope, _ := claims["scope"].(string)
+	scopes := strings.Fields(scope)
+
+	var client models.OAuthClient
+	if err := s.db.Where("client_id = ? AND revoked_at IS NULL", clientID).First(&client).Error; err != nil {
+		return nil, errors.New("client has been revoked")
+	}
+	allowed := models.OAuthClientScopes
+	if userID != 0 {
+		var consent models.OAuthConsent
+		err := s.db.Where("user_id = ? AND client_id = ? AND revoked_at IS NULL", uint(userID), clientID).First(&consent).Error
+		if err != nil {
+			return nil, errors.New("consent has been revoked")
+		}
+		if !scopesCovered(consent.Scopes, scopes) {
+			return nil, errors.New("consent no longer covers the token scopes")
+		}
+		allowed = models.OAuthUserScopes
+	}
+	if !scopesCovered(allowed, scopes) || !scopesCovered(client.Scopes, scopes) {
+		return nil, errors.New("invalid access token")
+	}
+
+	role, _ := claims["role"].(string)
+	tokenID, _ := claims["jti"].(string)
+	return &AccessClaims{UserID: uint(userID), Role: role, TokenID: tokenID, ClientID: clientID, Scopes: scopes}, nil
+}
+
+// Resolve the requested space-separated scopes against what the client was
+// registered with and what the grant allows. No request means all of them.
+func grantScopes(clientScopes, grantable []string, requested string) ([]string, error) {
+	var available []string
+	for _, scope := range clientScopes {
+		if containsScope(grantable, scope) {
+			available = append(available, scope)
+		}
+	}
+
+	if requested == "" {
+		if len(available) == 0 {
+			return nil, errors.New("client has no scopes for this grant")
+		}
+		return available, nil
+	}
+
+	var scopes []string
+	for _, scope := range strings.Fields(requested) {
+		if !containsScope(available, scope) {
+			return nil, fmt.Errorf("scope %q is not available to this client", scope)
+		}
+		if !containsScope(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
+
+// Redirect URIs must be absolute, without a fragment, and use https unless
+// they point at the loopback interface of a native app
+func checkRedirectURI(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" {
+		return fmt.Errorf("invalid redirect URI %q", raw)
+	}
+	if u.Scheme == "https" {
+		return nil
+	}
+	if host := u.Hostname(); u.Scheme == "http" && (host == "localhost" || host == "127.0.0.1" || host == "::1") {
+		return nil
+	}
+	return fmt.Errorf("redirect URI %q must use https", raw)
+}
+
+func appendQuery(redirectURI string, params url.Values) string {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+	query := u.Query()
+	for k, v := range params {
+		query[k] = v
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func containsScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Report whether every scope in want is in have
+func scopesCovered(have, want []string) bool {
+	for _, scope := range want {
+		if !containsScope(have, scope) {
+			return false
+		}
+	}
+	return true
+}
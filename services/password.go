@@ -0,0 +1,268 @@
+package services
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"bbank/models"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// Rules new passwords must follow, and how they are hashed
+type PasswordPolicy struct {
+	MinLength  int
+	MinClasses int                 // distinct classes out of lower, upper, digit and symbol
+	History    int                 // previous passwords that may not be reused, 0 disables
+	Breached   map[string]struct{} // upper-case hex SHA-1 of known breached passwords
+	Argon2     Argon2Params
+}
+
+// Cost of Argon2id hashes. Stored hashes made with other parameters are
+// replaced on the next successful login.
+type Argon2Params struct {
+	Memory     uint32 // KiB
+	Iterations uint32
+	Threads    uint8
+}
+
+// Returned when a new password does not satisfy the policy
+type PasswordPolicyError struct {
+	Reason string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return "password " + e.Reason
+}
+
+// Read a breached password list with one SHA-1 hash per line. Lines in the
+// "HASH:COUNT" format of Have I Been Pwned downloads are accepted.
+func LoadBreachedPasswords(path string) (map[string]struct{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hashes := make(map[string]struct{})
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		entry, _, _ = strings.Cut(entry, ":")
+		if _, err := hex.DecodeString(entry); err != nil || len(entry) != sha1.Size*2 {
+			return nil, fmt.Errorf("%s:%d: not a SHA-1 hash", path, line)
+		}
+		hashes[strings.ToUpper(entry)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// Check a new password against the length, character class and breached
+// password rules
+func (p PasswordPolicy) Check(password string) error {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return &PasswordPolicyError{Reason: fmt.Sprintf("must be at least %d characters long", p.MinLength)}
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, symbol} {
+		if present {
+			classes++
+		}
+	}
+	if classes < p.MinClasses {
+		return &PasswordPolicyError{Reason: fmt.Sprintf("must mix at least %d of lower case letters, upper case letters, digits and symbols", p.MinClasses)}
+	}
+
+	if len(p.Breached) > 0 {
+		digest := sha1.Sum([]byte(password))
+		if _, found := p.Breached[strings.ToUpper(hex.EncodeToString(digest[:]))]; found {
+			return &PasswordPolicyError{Reason: "has appeared in a data breach, please choose another one"}
+		}
+	}
+	return nil
+}
+
+// Apply the policy to a new password of the user, store its hash and
+// remember it in the history
+func (s *AuthService) setPassword(tx *gorm.DB, user *models.User, password string) error {
+	if err := s.passwords.Check(password); err != nil {
+		return err
+	}
+	if err := s.checkPasswordReuse(tx, user, password); err != nil {
+		return err
+	}
+
+	hash, err := s.hashPassword(password)
+	if err != nil {
+		return err
+	}
+	if err := tx.Model(user).Update("password", hash).Error; err != nil {
+		return err
+	}
+	user.Password = hash
+	return s.recordPasswordHistory(tx, user.ID, hash)
+}
+
+// Refuse the current password and the last History ones
+func (s *AuthService) checkPasswordReuse(tx *gorm.DB, user *models.User, password string) error {
+	if s.passwords.History <= 0 {
+		return nil
+	}
+
+	var previous []models.PasswordHistory
+	err := tx.Where("user_id = ?", user.ID).
+		Order("id DESC").
+		Limit(s.passwords.History).
+		Find(&previous).Error
+	if err != nil {
+		return err
+	}
+
+	hashes := []string{user.Password}
+	for _, p := range previous {
+		if p.Hash != user.Password {
+			hashes = append(hashes, p.Hash)
+		}
+	}
+	for _, hash := range hashes {
+		if ok, _ := s.verifyPassword(hash, password); ok {
+			return &PasswordPolicyError{Reason: fmt.Sprintf("must differ from your last %d passwords", s.passwords.History)}
+		}
+	}
+	return nil
+}
+
+// Add a hash to the user's history, dropping entries beyond the limit
+func (s *AuthService) recordPasswordHistory(tx *gorm.DB, userID uint, hash string) error {
+	if s.passwords.History <= 0 {
+		return nil
+	}
+	if err := tx.Create(&models.PasswordHistory{UserID: userID, Hash: hash}).Error; err != nil {
+		return err
+	}
+	return tx.Where("user_id = ? AND id NOT IN (?)", userID,
+		tx.Model(&models.PasswordHistory{}).Select("id").Where("user_id = ?", userID).Order("id DESC").Limit(s.passwords.History)).
+		Delete(&models.PasswordHistory{}).Error
+}
+
+// Hash a password with Argon2id in the PHC string format
+func (s *AuthService) hashPassword(password string) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	params := s.passwords.Argon2
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Threads, argon2KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, params.Memory, params.Iterations, params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Spend the time of a password check on a login for an unknown email, so
+// that the response time does not tell which emails are registered
+func (s *AuthService) verifyDummyPassword(password string) {
+	s.dummyHashOnce.Do(func() {
+		var err error
+		if s.dummyHash, err = s.hashPassword(uuid.NewString()); err != nil {
+			log.Printf("Failed to create dummy password hash: %v", err)
+		}
+	})
+	s.verifyPassword(s.dummyHash, password)
+}
+
+// Compare a password with a stored Argon2id or bcrypt hash. Also reports
+// whether the hash should be replaced because it uses an older algorithm
+// or different parameters.
+func (s *AuthService) verifyPassword(encoded, password string) (ok bool, rehash bool) {
+	if strings.HasPrefix(encoded, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password)) == nil, true
+	}
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, false
+	}
+	var version int
+	var params Argon2Params
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Threads); err != nil {
+		return false, false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(want) == 0 {
+		return false, false
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Threads, uint32(len(want)))
+	if subtle.ConstantTimeCompare(key, want) != 1 {
+		return false, false
+	}
+	return true, params != s.passwords.Argon2 || len(salt) != argon2SaltLength || len(want) != argon2KeyLength
+}
+
+// Replace the stored hash after a successful login, unless the password
+// changed in the meantime
+func (s *AuthService) rehashPassword(user *models.User, password string) error {
+	hash, err := s.hashPassword(password)
+	if err != nil {
+		return err
+	}
+	result := s.db.Model(&models.User{}).
+		Where("id = ? AND password = ?", user.ID, user.Password).
+		Update("password", hash)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("password changed during login")
+	}
+	user.Password = hash
+	return nil
+}
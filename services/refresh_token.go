@@ -0,0 +1,190 @@
+package services
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"bbank/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used, all sessions of this login were revoked")
+)
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// Exchange a refresh token for a new token pair in the same family. The
+// presented token can not be used again; replaying it revokes the family.
+func (s *AuthService) RotateRefreshToken(tokenString string, client ClientInfo) (access_token string, refresh_token string, err error) {
+	jti, err := s.parseRefreshToken(tokenString)
+	if err != nil {
+		return "", "", err
+	}
+
+	reused := false
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		stored, err := lockRefreshToken(tx, jti, tokenString)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if stored.UsedAt != nil {
+			// Someone holds a copy of a rotated token: kill the whole chain
+			reused = true
+			return revokeSessions(tx, tx.Where("id = ?", stored.FamilyID), now)
+		}
+		if stored.RevokedAt != nil || now.After(stored.ExpiresAt) {
+			return ErrInvalidRefreshToken
+		}
+
+		// Reload the user so role changes and deletions apply on refresh
+		var user models.User
+		if err := tx.First(&user, stored.UserID).Error; err != nil {
+			return ErrInvalidRefreshToken
+		}
+
+		if err := tx.Model(stored).Update("used_at", now).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.Session{}).Where("id = ?", stored.FamilyID).Updates(map[string]interface{}{
+			"ip_address":   client.IPAddress,
+			"user_agent":   client.UserAgent,
+			"last_seen_at": now,
+			"expires_at":   now.Add(s.refreshTokenTTL),
+		}).Error; err != nil {
+			return err
+		}
+
+		access_token, refresh_token, err = s.issueTokens(tx, user.ID, user.Role, stored.FamilyID)
+		return err
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if reused {
+		log.Printf("Refresh token %s replayed, family revoked", jti)
+		return "", "", ErrRefreshTokenReused
+	}
+
+	return access_token, refresh_token, nil
+}
+
+// End the session of the given refresh token
+func (s *AuthService) Logout(tokenString string) error {
+	jti, err := s.parseRefreshToken(tokenString)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		stored, err := lockRefreshToken(tx, jti, tokenString)
+		if err != nil {
+			return err
+		}
+		return revokeSessions(tx, tx.Where("id = ?", stored.FamilyID), time.Now())
+	})
+}
+
+// End every session of the user
+func (s *AuthService) LogoutAll(userID uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		return revokeSessions(tx, tx.Where("user_id = ?", userID), time.Now())
+	})
+}
+
+// Sign an access token and a refresh token, and persist the refresh token
+func (s *AuthService) issueTokens(tx *gorm.DB, userID uint, role, familyID string) (string, string, error) {
+	accessToken, err := s.signAccessToken(userID, role, familyID)
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	jti := uuid.NewString()
+	expiresAt := now.Add(s.refreshTokenTTL)
+
+	refreshClaims := jwt.MapClaims{
+		"user_id": userID,
+		"jti":     jti,
+		"exp":     expiresAt.Unix(),
+		"iat":     now.Unix(),
+		"type":    "refresh",
+	}
+
+	refreshToken, err := s.keys.Sign(refreshClaims)
+	if err != nil {
+		return "", "", err
+	}
+
+	stored := models.RefreshToken{
+		UserID:    userID,
+		JTI:       jti,
+		FamilyID:  familyID,
+		TokenHash: hashToken(refreshToken),
+		ExpiresAt: expiresAt,
+	}
+	if err := tx.Create(&stored).Error; err != nil {
+		return "", "", err
+	}
+
+	return accessToken, refreshToken, nil
+}
+
+// Check signature and type of a refresh token and return its jti
+func (s *AuthService) parseRefreshToken(tokenString string) (string, error) {
+	token, err := s.keys.Parse(tokenString)
+
+	if err != nil || !token.Valid {
+		return "", ErrInvalidRefreshToken
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["type"] != "refresh" {
+		return "", ErrInvalidRefreshToken
+	}
+
+	// Tokens issued before rotation have no jti and are no longer accepted
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return "", ErrInvalidRefreshToken
+	}
+	return jti, nil
+}
+
+func lockRefreshToken(tx *gorm.DB, jti, tokenString string) (*models.RefreshToken, error) {
+	var stored models.RefreshToken
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("jti = ?", jti).
+		First(&stored).Error
+	if err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+	if subtle.ConstantTimeCompare([]byte(stored.TokenHash), []byte(hashToken(tokenString))) != 1 {
+		return nil, ErrInvalidRefreshToken
+	}
+	return &stored, nil
+}
+
+func revokeRefreshTokens(query *gorm.DB, now time.Time) error {
+	return query.Model(&models.RefreshToken{}).
+		Where("revoked_at IS NULL").
+		Update("revoked_at", now).Error
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,208 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+
+	"bbank/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrTransactionNotFound = errors.New("transaction not found")
+	ErrNotRefundable       = errors.New("transaction cannot be reversed or refunded")
+	ErrRefundExceedsAmount = errors.New("refund exceeds the remaining transaction amount")
+	ErrOwnTransaction      = errors.New("staff cannot reverse or refund their own transactions")
+)
+
+type RefundRequest struct {
+	Amount models.Money `json:"amount" binding:"required,gt=0,lte=100000000000000"`
+}
+
+// Fully reverse a transaction on behalf of a staff member, compensating
+// whatever was not refunded yet
+func (s *TransactionService) Reverse(transactionID, staffID uint) (*models.Transaction, error) {
+	return s.compensate(transactionID, staffID, 0, models.TransactionTypeReversal)
+}
+
+// Refund part of a transaction on behalf of a staff member; may be called
+// several times
+func (s *TransactionService) Refund(transactionID, staffID uint, amount models.Money) (*models.Transaction, error) {
+	if amount <= 0 {
+		return nil, errors.New("refund amount must be positive")
+	}
+	return s.compensate(transactionID, staffID, amount, models.TransactionTypeRefund)
+}
+
+// Create a compensating transaction that moves amount back along the
+// original journal entry. An amount of zero means the remaining amount.
+// Staff may compensate any transaction except those they took part in, so
+// nobody can claw back a transfer they sent.
+func (s *TransactionService) compensate(transactionID, staffID uint, amount models.Money, txType string) (*models.Transaction, error) {
+	var compensation models.Transaction
+
+	err := s.balanceService.runInTransaction(func(tx *gorm.DB) error {
+		var original models.Transaction
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ?", transactionID).
+			First(&original).Error
+		if err != nil {
+			return ErrTransactionNotFound
+		}
+		if (original.ToUserID != nil && *original.ToUserID == staffID) ||
+			(original.FromUserID != nil && *original.FromUserID == staffID) {
+			return ErrOwnTransaction
+		}
+
+		switch original.Type {
+		case models.TransactionTypeCredit, models.TransactionTypeDebit, models.TransactionTypeTransfer:
+		default:
+			return ErrNotRefundable
+		}
+		if original.Status != models.TransactionStatusCompleted &&
+			original.Status != models.TransactionStatusPartiallyRefunded {
+			return ErrNotRefundable
+		}
+
+		remaining := original.Amount - original.RefundedAmount
+		refund := amount
+		if refund == 0 {
+			refund = remaining
+		}
+		if refund > remaining {
+			return ErrRefundExceedsAmount
+		}
+
+		var entry models.JournalEntry
+		if err := tx.Preload("Postings").Where("transaction_id = ?", original.ID).First(&entry).Error; err != nil {
+			return fmt.Errorf("journal entry for transaction %d not found", original.ID)
+		}
+
+		// Every leg of the original entry moves back in proportion to the
+		// refund. Working from cumulative totals keeps converted legs from
+		// drifting through rounding over several partial refunds.
+		refundedBefore := original.RefundedAmount
+		refundedAfter := original.RefundedAmount + refund
+		postings := make([]models.Posting, 0, len(entry.Postings))
+		deltas := make(map[uint]models.Money)
+		accountIDs := make([]uint, 0, len(entry.Postings))
+		var converted models.Money
+		for _, p := range entry.Postings {
+			delta := scaleMoney(p.Amount, refundedBefore, original.Amount) -
+				scaleMoney(p.Amount, refundedAfter, original.Amount)
+			if p.AccountID != nil {
+				postings = append(postings, models.Posting{
+					AccountID: p.AccountID,
+					UserID:    p.UserID,
+					Currency:  p.Currency,
+					Amount:    delta,
+				})
+				if _, seen := deltas[*p.AccountID]; !seen {
+					accountIDs = append(accountIDs, *p.AccountID)
+				}
+				deltas[*p.AccountID] += delta
+				if original.ToAccountID != nil && *p.AccountID == *original.ToAccountID &&
+					p.Currency == original.ConvertedCurrency {
+					converted = -delta
+				}
+			} else {
+				postings = append(postings, systemPosting(p.SystemAccount, p.Currency, delta))
+			}
+		}
+
+		balances, err := s.balanceService.lockBalances(tx, accountIDs...)
+		if err != nil {
+			return err
+		}
+		for _, id := range accountIDs {
+			balance, ok := balances[id]
+			if !ok {
+				return errors.New("balance not found")
+			}
+			if balance.Available()+deltas[id] < 0 {
+				return ErrInsufficientFunds
+			}
+		}
+
+		compensation = models.Transaction{
+			Amount:                refund,
+			Currency:              original.Currency,
+			Type:                  txType,
+			Status:                models.TransactionStatusCompleted,
+			OriginalTransactionID: &original.ID,
+		}
+		// Money flows back the other way: out of the credited account, into
+		// the debited one
+		compensation.FromUserID = original.ToUserID
+		compensation.FromAccountID = original.ToAccountID
+		compensation.ToUserID = original.FromUserID
+		compensation.ToAccountID = original.FromAccountID
+
+		if original.ConvertedAmount != nil {
+			compensation.ConvertedAmount = &converted
+			compensation.ConvertedCurrency = original.ConvertedCurrency
+			compensation.FXRate = original.FXRate
+			compensation.FXSpread = original.FXSpread
+		}
+
+		if err := tx.Create(&compensation).Error; err != nil {
+			return err
+		}
+
+		description := fmt.Sprintf("%s of transaction %d", txType, original.ID)
+		if _, err := s.ledgerService.Post(tx, &compensation.ID, description, postings...); err != nil {
+			return err
+		}
+
+		for _, id := range accountIDs {
+			balance := balances[id]
+			if balance.Amount, err = balance.Amount.Add(deltas[id]); err != nil {
+				return err
+			}
+			if err := s.balanceService.saveBalance(tx, balance); err != nil {
+				return err
+			}
+		}
+
+		// Move the original to its new status
+		original.RefundedAmount += refund
+		switch {
+		case txType == models.TransactionTypeReversal:
+			original.Status = models.TransactionStatusReversed
+		case original.RefundedAmount == original.Amount:
+			original.Status = models.TransactionStatusRefunded
+		default:
+			original.Status = models.TransactionStatusPartiallyRefunded
+		}
+
+		err = tx.Model(&original).Updates(map[string]interface{}{
+			"refunded_amount": original.RefundedAmount,
+			"status":          original.Status,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		if err := auditTransaction(tx, &compensation, "created"); err != nil {
+			return err
+		}
+		action := "refunded"
+		if txType == models.TransactionTypeReversal {
+			action = "reversed"
+		}
+		return recordAudit(tx, "transaction", original.ID, action, map[string]interface{}{
+			"by_transaction_id": compensation.ID,
+			"amount":            refund,
+			"refunded_amount":   original.RefundedAmount,
+			"status":            original.Status,
+			"staff_id":          staffID,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &compensation, nil
+}
@@ -0,0 +1,100 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"bbank/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// How often last_seen_at of a session is written while it is in use
+const sessionTouchInterval = time.Minute
+
+// Where a login or refresh came from
+type ClientInfo struct {
+	IPAddress string
+	UserAgent string
+}
+
+// Get the active sessions of a user, most recently used first
+func (s *AuthService) GetActiveSessions(userID uint) ([]models.Session, error) {
+	var sessions []models.Session
+	err := s.db.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at DESC").
+		Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// Revoke one session of the user together with its refresh tokens. Access
+// tokens of the session stop working immediately.
+func (s *AuthService) RevokeSession(userID uint, sessionID string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var session models.Session
+		if err := tx.Where("id = ? AND user_id = ?", sessionID, userID).First(&session).Error; err != nil {
+			return ErrSessionNotFound
+		}
+		return revokeSessions(tx, tx.Where("id = ?", session.ID), time.Now())
+	})
+}
+
+func (s *AuthService) startSession(tx *gorm.DB, userID uint, client ClientInfo) (*models.Session, error) {
+	now := time.Now()
+	session := models.Session{
+		ID:         uuid.NewString(),
+		UserID:     userID,
+		IPAddress:  client.IPAddress,
+		UserAgent:  client.UserAgent,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(s.refreshTokenTTL),
+	}
+	if err := tx.Create(&session).Error; err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Make sure the session behind an access token is still live and its user
+// was not deleted, and record that it was used
+func (s *AuthService) checkSession(sessionID string, userID uint) error {
+	var session models.Session
+	err := s.db.Where("id = ? AND user_id = ?", sessionID, userID).
+		Where("EXISTS (SELECT 1 FROM users WHERE users.id = sessions.user_id AND users.deleted_at IS NULL)").
+		First(&session).Error
+	if err != nil {
+		return ErrSessionNotFound
+	}
+
+	now := time.Now()
+	if session.RevokedAt != nil || now.After(session.ExpiresAt) {
+		return errors.New("session is no longer active")
+	}
+
+	if now.Sub(session.LastSeenAt) > sessionTouchInterval {
+		return s.db.Model(&session).Update("last_seen_at", now).Error
+	}
+	return nil
+}
+
+// Revoke the sessions matched by query and every refresh token issued to them
+func revokeSessions(tx, query *gorm.DB, now time.Time) error {
+	var ids []string
+	if err := query.Model(&models.Session{}).Where("revoked_at IS NULL").Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	if err := tx.Model(&models.Session{}).Where("id IN ?", ids).Update("revoked_at", now).Error; err != nil {
+		return err
+	}
+	return revokeRefreshTokens(tx.Where("family_id IN ?", ids), now)
+}
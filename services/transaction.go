@@ -12,156 +12,277 @@ import (
 type TransactionService struct {
 	db             *gorm.DB
 	balanceService *BalanceService
+	ledgerService  *LedgerService
+	fxService      *FXService
+	holdTTL        time.Duration
 }
 
+// Currency is optional and must match the account currency when given
 type TransactionRequest struct {
-	Amount   float64 `json:"amount" binding:"required,gt=0"`
-	ToUserID *uint   `json:"to_user_id,omitempty"`
+	Amount    models.Money `json:"amount" binding:"required,gt=0,lte=100000000000000"`
+	Currency  string       `json:"currency,omitempty" binding:"omitempty,len=3"`
+	AccountID *uint        `json:"account_id,omitempty"` // defaults to the user's default account
+	ToUserID  *uint        `json:"to_user_id,omitempty"`
 }
 
+// The recipient is either an explicit account or the default account of a
+// user. Amount is in the sender's currency and converted when the recipient
+// account holds another currency.
 type TransferRequest struct {
-	Amount   float64 `json:"amount" binding:"required,gt=0"`
-	ToUserID uint    `json:"to_user_id" binding:"required"`
+	Amount        models.Money `json:"amount" binding:"required,gt=0,lte=100000000000000"`
+	Currency      string       `json:"currency,omitempty" binding:"omitempty,len=3"`
+	FromAccountID *uint        `json:"from_account_id,omitempty"`
+	ToUserID      *uint        `json:"to_user_id,omitempty" binding:"required_without=ToAccountID"`
+	ToAccountID   *uint        `json:"to_account_id,omitempty"`
 }
 
-func NewTransactionService(db *gorm.DB, balanceService *BalanceService) *TransactionService {
+func NewTransactionService(db *gorm.DB, balanceService *BalanceService, ledgerService *LedgerService, fxService *FXService, holdTTL time.Duration) *TransactionService {
 	return &TransactionService{
 		db:             db,
 		balanceService: balanceService,
+		ledgerService:  ledgerService,
+		fxService:      fxService,
+		holdTTL:        holdTTL,
 	}
 }
 
-// Credit money to user account
-func (s *TransactionService) Credit(userID uint, amount float64) (*models.Transaction, error) {
+// Credit money to one of the user's accounts
+func (s *TransactionService) Credit(userID, accountID uint, amount models.Money, currency string) (*models.Transaction, error) {
 	var transaction models.Transaction
 
-	err := s.db.Transaction(func(tx *gorm.DB) error {
+	err := s.balanceService.runInTransaction(func(tx *gorm.DB) error {
+		account, err := loadOwnedAccount(tx, userID, accountID)
+		if err != nil {
+			return err
+		}
+		if err := checkCurrency(account, currency); err != nil {
+			return err
+		}
+
 		// Create transaction record
 		transaction = models.Transaction{
-			ToUserID: userID,
-			Amount:   amount,
-			Type:     "credit",
-			Status:   "completed",
+			ToUserID:    &userID,
+			ToAccountID: &accountID,
+			Amount:      amount,
+			Currency:    account.Currency,
+			Type:        models.TransactionTypeCredit,
+			Status:      models.TransactionStatusCompleted,
 		}
 
 		if err := tx.Create(&transaction).Error; err != nil {
 			return err
 		}
 
+		// Cash enters the bank and is owed to the account holder
+		if _, err := s.ledgerService.Post(tx, &transaction.ID, "credit",
+			systemPosting(models.SystemAccountCashIn, account.Currency, -amount),
+			accountPosting(account, amount),
+		); err != nil {
+			return err
+		}
+
 		// Update balance directly in this transaction (avoid nested transaction)
-		var balance models.Balance
-		if err := tx.Where("user_id = ?", userID).First(&balance).Error; err != nil {
+		balances, err := s.balanceService.lockBalances(tx, accountID)
+		if err != nil {
 			return err
 		}
+		balance, ok := balances[accountID]
+		if !ok {
+			return errors.New("balance not found")
+		}
 
-		balance.Amount += amount
-		balance.LastUpdatedAt = time.Now()
+		if balance.Amount, err = balance.Amount.Add(amount); err != nil {
+			return err
+		}
 
-		if err := tx.Save(&balance).Error; err != nil {
+		if err := s.balanceService.saveBalance(tx, balance); err != nil {
 			return err
 		}
 
-		return nil
+		return auditTransaction(tx, &transaction, "created")
 	})
 
 	return &transaction, err
 }
 
-// Debit money from user account
-func (s *TransactionService) Debit(userID uint, amount float64) (*models.Transaction, error) {
+// Debit money from one of the user's accounts
+func (s *TransactionService) Debit(userID, accountID uint, amount models.Money, currency string) (*models.Transaction, error) {
 	var transaction models.Transaction
 
-	err := s.db.Transaction(func(tx *gorm.DB) error {
-		// Check balance and update in same transaction
-		var balance models.Balance
-		if err := tx.Where("user_id = ?", userID).First(&balance).Error; err != nil {
+	err := s.balanceService.runInTransaction(func(tx *gorm.DB) error {
+		account, err := loadOwnedAccount(tx, userID, accountID)
+		if err != nil {
+			return err
+		}
+		if err := checkCurrency(account, currency); err != nil {
 			return err
 		}
 
-		if balance.Amount < amount {
-			return errors.New("insufficient funds")
+		// Lock the balance so concurrent debits cannot both pass the check
+		balances, err := s.balanceService.lockBalances(tx, accountID)
+		if err != nil {
+			return err
+		}
+		balance, ok := balances[accountID]
+		if !ok {
+			return errors.New("balance not found")
+		}
+
+		if balance.Available() < amount {
+			return ErrInsufficientFunds
 		}
 
 		// Create transaction record
 		transaction = models.Transaction{
-			FromUserID: &userID,
-			ToUserID:   userID,
-			Amount:     amount,
-			Type:       "debit",
-			Status:     "completed",
+			FromUserID:    &userID,
+			FromAccountID: &accountID,
+			Amount:        amount,
+			Currency:      account.Currency,
+			Type:          models.TransactionTypeDebit,
+			Status:        models.TransactionStatusCompleted,
 		}
 
 		if err := tx.Create(&transaction).Error; err != nil {
 			return err
 		}
 
+		// Cash leaves the bank out of the account
+		if _, err := s.ledgerService.Post(tx, &transaction.ID, "debit",
+			accountPosting(account, -amount),
+			systemPosting(models.SystemAccountCashOut, account.Currency, amount),
+		); err != nil {
+			return err
+		}
+
 		// Update balance
-		balance.Amount -= amount
-		balance.LastUpdatedAt = time.Now()
+		if balance.Amount, err = balance.Amount.Sub(amount); err != nil {
+			return err
+		}
 
-		if err := tx.Save(&balance).Error; err != nil {
+		if err := s.balanceService.saveBalance(tx, balance); err != nil {
 			return err
 		}
 
-		return nil
+		return auditTransaction(tx, &transaction, "created")
 	})
 
 	return &transaction, err
 }
 
-// Transfer money between users
-func (s *TransactionService) Transfer(fromUserID, toUserID uint, amount float64) (*models.Transaction, error) {
-	if fromUserID == toUserID {
+// Transfer money from one of the user's accounts to any active account,
+// converting through the FX position when the currencies differ
+func (s *TransactionService) Transfer(fromUserID, fromAccountID, toAccountID uint, amount models.Money, currency string) (*models.Transaction, error) {
+	if fromAccountID == toAccountID {
 		return nil, errors.New("cannot transfer to same account")
 	}
 
 	var transaction models.Transaction
 
-	err := s.db.Transaction(func(tx *gorm.DB) error {
-		// Get both balances in single transaction
-		var fromBalance, toBalance models.Balance
+	err := s.balanceService.runInTransaction(func(tx *gorm.DB) error {
+		fromAccount, err := loadOwnedAccount(tx, fromUserID, fromAccountID)
+		if err != nil {
+			return errors.New("sender account not found")
+		}
 
-		if err := tx.Where("user_id = ?", fromUserID).First(&fromBalance).Error; err != nil {
+		toAccount, err := loadActiveAccount(tx, toAccountID)
+		if err != nil {
+			return errors.New("recipient account not found")
+		}
+
+		if err := checkCurrency(fromAccount, currency); err != nil {
+			return err
+		}
+
+		// Amount the recipient receives, in the recipient's currency
+		received := amount
+		var conversion *Conversion
+		if fromAccount.Currency != toAccount.Currency {
+			conversion, err = s.fxService.Convert(tx, fromAccount.Currency, toAccount.Currency, amount)
+			if err != nil {
+				return err
+			}
+			if conversion.ConvertedAmount <= 0 {
+				return errors.New("amount is too small to convert")
+			}
+			received = conversion.ConvertedAmount
+		}
+
+		// Lock both balances in ascending account ID order
+		balances, err := s.balanceService.lockBalances(tx, fromAccountID, toAccountID)
+		if err != nil {
+			return err
+		}
+
+		fromBalance, ok := balances[fromAccountID]
+		if !ok {
 			return errors.New("sender account not found")
 		}
 
-		if err := tx.Where("user_id = ?", toUserID).First(&toBalance).Error; err != nil {
+		toBalance, ok := balances[toAccountID]
+		if !ok {
 			return errors.New("recipient account not found")
 		}
 
-		if fromBalance.Amount < amount {
-			return errors.New("insufficient funds")
+		if fromBalance.Available() < amount {
+			return ErrInsufficientFunds
 		}
 
 		// Create transaction record
 		transaction = models.Transaction{
-			FromUserID: &fromUserID,
-			ToUserID:   toUserID,
-			Amount:     amount,
-			Type:       "transfer",
-			Status:     "completed",
+			FromUserID:    &fromUserID,
+			ToUserID:      &toAccount.UserID,
+			FromAccountID: &fromAccountID,
+			ToAccountID:   &toAccountID,
+			Amount:        amount,
+			Currency:      fromAccount.Currency,
+			Type:          models.TransactionTypeTransfer,
+			Status:        models.TransactionStatusCompleted,
+		}
+		if conversion != nil {
+			transaction.ConvertedAmount = &conversion.ConvertedAmount
+			transaction.ConvertedCurrency = conversion.ToCurrency
+			transaction.FXRate = &conversion.Rate
+			transaction.FXSpread = &conversion.Spread
 		}
 
 		if err := tx.Create(&transaction).Error; err != nil {
 			return err
 		}
 
+		postings := []models.Posting{
+			accountPosting(fromAccount, -amount),
+			accountPosting(toAccount, received),
+		}
+		if conversion != nil {
+			// The bank buys the sender's currency and sells the recipient's
+			postings = append(postings,
+				systemPosting(models.SystemAccountFXPosition, fromAccount.Currency, amount),
+				systemPosting(models.SystemAccountFXPosition, toAccount.Currency, -received),
+			)
+		}
+
+		if _, err := s.ledgerService.Post(tx, &transaction.ID, "transfer", postings...); err != nil {
+			return err
+		}
+
 		// Update both balances
-		fromBalance.Amount -= amount
-		fromBalance.LastUpdatedAt = time.Now()
+		if fromBalance.Amount, err = fromBalance.Amount.Sub(amount); err != nil {
+			return err
+		}
 
-		toBalance.Amount += amount
-		toBalance.LastUpdatedAt = time.Now()
+		if toBalance.Amount, err = toBalance.Amount.Add(received); err != nil {
+			return err
+		}
 
-		if err := tx.Save(&fromBalance).Error; err != nil {
+		if err := s.balanceService.saveBalance(tx, fromBalance); err != nil {
 			return err
 		}
 
-		if err := tx.Save(&toBalance).Error; err != nil {
+		if err := s.balanceService.saveBalance(tx, toBalance); err != nil {
 			return err
 		}
 
-		return nil
+		return auditTransaction(tx, &transaction, "created")
 	})
 
 	return &transaction, err
@@ -198,11 +319,27 @@ func (s *TransactionService) GetTransaction(transactionID, userID uint) (*models
 		transactionID, userID, userID).
 		Preload("FromUser").
 		Preload("ToUser").
+		Preload("OriginalTransaction").
+		Preload("Refunds", func(db *gorm.DB) *gorm.DB {
+			return db.Order("created_at ASC")
+		}).
 		First(&transaction).Error
 
 	if err != nil {
-		return nil, errors.New("transaction not found")
+		return nil, ErrTransactionNotFound
 	}
 
 	return &transaction, nil
 }
+
+// Record a money movement in the audit log; call it last in the transaction
+func auditTransaction(tx *gorm.DB, transaction *models.Transaction, action string) error {
+	return recordAudit(tx, "transaction", transaction.ID, action, map[string]interface{}{
+		"type":            transaction.Type,
+		"status":          transaction.Status,
+		"amount":          transaction.Amount,
+		"currency":        transaction.Currency,
+		"from_account_id": transaction.FromAccountID,
+		"to_account_id":   transaction.ToAccountID,
+	})
+}
@@ -0,0 +1,375 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"bbank/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrTwoFactorRequired       = errors.New("two-factor authentication code required")
+	ErrTwoFactorNotEnabled     = errors.New("two-factor authentication is not enabled")
+	ErrTwoFactorAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrInvalidTwoFactorCode    = errors.New("invalid two-factor authentication code")
+	ErrInvalidChallenge        = errors.New("invalid or expired login challenge")
+)
+
+// RFC 6238 parameters understood by common authenticator apps
+const (
+	totpIssuer        = "bbank"
+	totpPeriod        = 30 // seconds
+	totpDigits        = 6
+	totpSkew          = 1 // accepted steps before and after the current one
+	recoveryCodeCount = 10
+	challengeTTL      = 5 * time.Minute
+)
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type TwoFactorLoginRequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	Code           string `json:"code" binding:"required"` // TOTP or recovery code
+}
+
+type TOTPSetup struct {
+	Secret string `json:"secret"`
+	URL    string `json:"otpauth_url"`
+}
+
+// Returned by Login instead of tokens when the user has 2FA enabled
+type TwoFactorChallenge struct {
+	TwoFactorRequired bool      `json:"two_factor_required"`
+	ChallengeToken    string    `json:"challenge_token"`
+	ExpiresAt         time.Time `json:"expires_at"`
+}
+
+// Generate a new TOTP secret for the user. 2FA stays disabled until a code
+// from it is verified.
+func (s *AuthService) SetupTOTP(userID uint) (*TOTPSetup, error) {
+	var user models.User
+	if err := s.db.First(&user, userID).Error; err != nil {
+		return nil, err
+	}
+	if user.TOTPEnabled {
+		return nil, ErrTwoFactorAlreadyEnabled
+	}
+
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw)
+
+	if err := s.db.Model(&user).Updates(map[string]interface{}{
+		"totp_secret":    secret,
+		"totp_last_step": 0,
+	}).Error; err != nil {
+		return nil, err
+	}
+
+	label := url.PathEscape(totpIssuer + ":" + user.Email)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("period", fmt.Sprint(totpPeriod))
+	query.Set("digits", fmt.Sprint(totpDigits))
+
+	return &TOTPSetup{
+		Secret: secret,
+		URL:    "otpauth://totp/" + label + "?" + query.Encode(),
+	}, nil
+}
+
+// Enable 2FA after checking a code from the new secret. Returns recovery
+// codes, which are shown only once. Wrong codes count as failed logins.
+func (s *AuthService) EnableTOTP(userID uint, code string, client ClientInfo) ([]string, error) {
+	user, err := s.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkLoginAllowed(user.Email, client); err != nil {
+		return nil, err
+	}
+
+	var codes []string
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		user, err := lockUser(tx, userID)
+		if err != nil {
+			return err
+		}
+		if user.TOTPEnabled {
+			return ErrTwoFactorAlreadyEnabled
+		}
+		if user.TOTPSecret == "" {
+			return errors.New("two-factor setup has not been started")
+		}
+		if err := checkTOTP(tx, user, code, time.Now()); err != nil {
+			return err
+		}
+
+		if err := tx.Model(user).Update("totp_enabled", true).Error; err != nil {
+			return err
+		}
+
+		codes, err = createRecoveryCodes(tx, userID)
+		return err
+	})
+	if errors.Is(err, ErrInvalidTwoFactorCode) {
+		s.recordLoginFailure(userID, user.Email, client, "invalid_totp_setup_code")
+		return nil, err
+	}
+	s.releaseLoginAttempt(user.Email, client)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Exchange a login challenge and a second factor for tokens. Each
+// challenge allows one attempt; after a wrong code the user logs in again.
+func (s *AuthService) CompleteTwoFactorLogin(req TwoFactorLoginRequest, client ClientInfo) (*AuthResponse, error) {
+	userID, challengeID, err := s.parseChallengeToken(req.ChallengeToken)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.GetUserByID(userID)
+	if err != nil {
+		return nil, ErrInvalidChallenge
+	}
+
+	// Guessing codes counts like guessing passwords
+	if err := s.checkLoginAllowed(user.Email, client); err != nil {
+		return nil, err
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		token, err := useUserToken(tx, challengeID, models.TokenPurposeTwoFactorLogin)
+		if err != nil || token.UserID != userID {
+			return ErrInvalidChallenge
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.VerifySecondFactor(userID, req.Code); err != nil {
+		if errors.Is(err, ErrInvalidTwoFactorCode) {
+			s.recordLoginFailure(user.ID, user.Email, client, "invalid_2fa_code")
+		} else {
+			s.releaseLoginAttempt(user.Email, client)
+		}
+		return nil, err
+	}
+	s.recordLoginSuccess(user, client)
+
+	access_token, refresh_token, err := s.GenerateToken(user.ID, user.Role, client)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuthResponse{
+		AccessToken:  access_token,
+		RefreshToken: refresh_token,
+		User:         *user,
+	}, nil
+}
+
+// Check the second factor sent for a step-up. Wrong codes count as failed
+// logins, so a stolen access token can not be used to guess them.
+func (s *AuthService) StepUp(userID uint, code string, client ClientInfo) error {
+	user, err := s.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if err := s.checkLoginAllowed(user.Email, client); err != nil {
+		return err
+	}
+	err = s.VerifySecondFactor(userID, code)
+	if errors.Is(err, ErrInvalidTwoFactorCode) {
+		s.recordLoginFailure(user.ID, user.Email, client, "invalid_step_up_code")
+		return err
+	}
+	s.releaseLoginAttempt(user.Email, client)
+	return err
+}
+
+// Check a TOTP code or consume a recovery code of the user
+func (s *AuthService) VerifySecondFactor(userID uint, code string) error {
+	if code == "" {
+		return ErrTwoFactorRequired
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		user, err := lockUser(tx, userID)
+		if err != nil {
+			return err
+		}
+		if !user.TOTPEnabled {
+			return ErrTwoFactorNotEnabled
+		}
+
+		// Recovery codes are longer than TOTP codes
+		if len(strings.TrimSpace(code)) == totpDigits {
+			return checkTOTP(tx, user, code, time.Now())
+		}
+		return useRecoveryCode(tx, userID, code)
+	})
+}
+
+// Sign a challenge token and remember its ID, so that it can be used once
+func (s *AuthService) issueChallenge(userID uint) (*TwoFactorChallenge, error) {
+	expiresAt := time.Now().Add(challengeTTL)
+	challengeID := uuid.NewString()
+	err := s.db.Create(&models.UserToken{
+		UserID:    userID,
+		Purpose:   models.TokenPurposeTwoFactorLogin,
+		TokenHash: hashToken(challengeID),
+		ExpiresAt: expiresAt,
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := s.keys.Sign(jwt.MapClaims{
+		"user_id": userID,
+		"jti":     challengeID,
+		"exp":     expiresAt.Unix(),
+		"iat":     time.Now().Unix(),
+		"type":    "2fa_challenge",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &TwoFactorChallenge{
+		TwoFactorRequired: true,
+		ChallengeToken:    token,
+		ExpiresAt:         expiresAt,
+	}, nil
+}
+
+// Get the user and challenge ID of a challenge token
+func (s *AuthService) parseChallengeToken(tokenString string) (uint, string, error) {
+	token, err := s.keys.Parse(tokenString)
+	if err != nil || !token.Valid {
+		return 0, "", ErrInvalidChallenge
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["type"] != "2fa_challenge" {
+		return 0, "", ErrInvalidChallenge
+	}
+	userID, ok := claims["user_id"].(float64)
+	if !ok {
+		return 0, "", ErrInvalidChallenge
+	}
+	challengeID, ok := claims["jti"].(string)
+	if !ok || challengeID == "" {
+		return 0, "", ErrInvalidChallenge
+	}
+	return uint(userID), challengeID, nil
+}
+
+func lockUser(tx *gorm.DB, userID uint) (*models.User, error) {
+	var user models.User
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, userID).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// Accept a code from the current time step or a neighbouring one, at most
+// once per step
+func checkTOTP(tx *gorm.DB, user *models.User, code string, now time.Time) error {
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(user.TOTPSecret)
+	if err != nil {
+		return err
+	}
+
+	code = strings.TrimSpace(code)
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= user.TOTPLastStep {
+			continue
+		}
+		if hmac.Equal([]byte(hotp(secret, step)), []byte(code)) {
+			user.TOTPLastStep = step
+			return tx.Model(user).Update("totp_last_step", step).Error
+		}
+	}
+	return ErrInvalidTwoFactorCode
+}
+
+// HMAC-based one-time password (RFC 4226) for the given counter
+func hotp(secret []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// Replace the user's recovery codes with fresh ones
+func createRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	rows := make([]models.RecoveryCode, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 6)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw))
+		codes[i] = code[:5] + "-" + code[5:]
+		rows[i] = models.RecoveryCode{UserID: userID, CodeHash: hashToken(code)}
+	}
+
+	if err := tx.Create(&rows).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func useRecoveryCode(tx *gorm.DB, userID uint, code string) error {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+
+	result := tx.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashToken(normalized)).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidTwoFactorCode
+	}
+	return nil
+}
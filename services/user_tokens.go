@@ -0,0 +1,228 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"bbank/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrInvalidUserToken     = errors.New("invalid or expired token")
+	ErrEmailNotVerified     = errors.New("email address is not verified")
+	ErrEmailAlreadyVerified = errors.New("email address is already verified")
+)
+
+const (
+	passwordResetTTL     = time.Hour
+	emailVerificationTTL = 48 * time.Hour
+	userTokenResendDelay = time.Minute // minimum time between two mails of the same kind
+)
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// Mail a password reset link in the background. Unknown emails are ignored
+// and nothing is awaited, so that neither the response nor its timing
+// reveals which addresses have accounts.
+func (s *AuthService) ForgotPassword(email string) {
+	go func() {
+		if err := s.sendPasswordReset(email); err != nil {
+			log.Printf("Failed to send password reset email: %v", err)
+		}
+	}()
+}
+
+func (s *AuthService) sendPasswordReset(email string) error {
+	var user models.User
+	if err := s.db.Where("email = ?", email).First(&user).Error; err != nil {
+		return nil
+	}
+
+	token, err := s.createUserToken(user.ID, models.TokenPurposePasswordReset, passwordResetTTL)
+	if err != nil || token == "" {
+		return err
+	}
+
+	body := fmt.Sprintf("Hello %s,\n\nUse the link below to choose a new password. It expires in %s.\n\n%s\n\nIf you did not ask for this, you can ignore this email.\n",
+		user.Username, passwordResetTTL, s.appLink("/reset-password", token))
+	return s.mailer.Send(user.Email, "Reset your password", body)
+}
+
+// Set a new password with a reset token. All sessions of the user end.
+func (s *AuthService) ResetPassword(req ResetPasswordRequest) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		token, err := useUserToken(tx, req.Token, models.TokenPurposePasswordReset)
+		if err != nil {
+			return err
+		}
+
+		var user models.User
+		if err := tx.First(&user, token.UserID).Error; err != nil {
+			return ErrInvalidUserToken
+		}
+		if err := s.setPassword(tx, &user, req.Password); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if err := revokeSessions(tx, tx.Where("user_id = ?", user.ID), now); err != nil {
+			return err
+		}
+		// Reading the mail proves control of the account, so lift a lockout
+		if err := tx.Where("scope = ? AND key = ?", models.LoginScopeAccount, loginKey(user.Email)).
+			Delete(&models.LoginThrottle{}).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, "user", user.ID, "password_reset", map[string]interface{}{})
+	})
+}
+
+// Mail an email verification link to the user
+func (s *AuthService) SendVerificationEmail(userID uint) error {
+	user, err := s.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if user.EmailVerifiedAt != nil {
+		return ErrEmailAlreadyVerified
+	}
+
+	token, err := s.createUserToken(user.ID, models.TokenPurposeEmailVerification, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return errors.New("a verification email was sent recently, please wait a minute")
+	}
+
+	body := fmt.Sprintf("Hello %s,\n\nPlease confirm your email address with the link below. It expires in %s.\n\n%s\n",
+		user.Username, emailVerificationTTL, s.appLink("/verify-email", token))
+	return s.mailer.Send(user.Email, "Confirm your email address", body)
+}
+
+// Mark the email of the token's user as verified
+func (s *AuthService) VerifyEmail(tokenString string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		token, err := useUserToken(tx, tokenString, models.TokenPurposeEmailVerification)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Model(&models.User{}).
+			Where("id = ? AND email_verified_at IS NULL", token.UserID).
+			Update("email_verified_at", time.Now()).Error
+		if err != nil {
+			return err
+		}
+		return recordAudit(tx, "user", token.UserID, "email_verified", map[string]interface{}{})
+	})
+}
+
+// Fail with ErrEmailNotVerified unless the user confirmed their email
+func (s *AuthService) CheckEmailVerified(userID uint) error {
+	var user models.User
+	if err := s.db.Select("email_verified_at").First(&user, userID).Error; err != nil {
+		return err
+	}
+	if user.EmailVerifiedAt == nil {
+		return ErrEmailNotVerified
+	}
+	return nil
+}
+
+// Issue a new token, replacing unused ones for the same purpose. Returns
+// an empty token without error if one was issued too recently.
+func (s *AuthService) createUserToken(userID uint, purpose string, ttl time.Duration) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var recent int64
+		err := tx.Model(&models.UserToken{}).
+			Where("user_id = ? AND purpose = ? AND used_at IS NULL AND created_at > ?", userID, purpose, time.Now().Add(-userTokenResendDelay)).
+			Count(&recent).Error
+		if err != nil {
+			return err
+		}
+		if recent > 0 {
+			token = ""
+			return nil
+		}
+
+		now := time.Now()
+		if err := invalidateUserTokens(tx, userID, now, purpose); err != nil {
+			return err
+		}
+
+		return tx.Create(&models.UserToken{
+			UserID:    userID,
+			Purpose:   purpose,
+			TokenHash: hashToken(token),
+			ExpiresAt: now.Add(ttl),
+		}).Error
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Mark the user's unused tokens for the given purposes as used
+func invalidateUserTokens(tx *gorm.DB, userID uint, now time.Time, purposes ...string) error {
+	return tx.Model(&models.UserToken{}).
+		Where("user_id = ? AND purpose IN ? AND used_at IS NULL", userID, purposes).
+		Update("used_at", now).Error
+}
+
+// Mark a valid token as used and return it
+func useUserToken(tx *gorm.DB, tokenString, purpose string) (*models.UserToken, error) {
+	var token models.UserToken
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("token_hash = ? AND purpose = ?", hashToken(tokenString), purpose).
+		First(&token).Error
+	if err != nil {
+		return nil, ErrInvalidUserToken
+	}
+
+	now := time.Now()
+	if token.UsedAt != nil || now.After(token.ExpiresAt) {
+		return nil, ErrInvalidUserToken
+	}
+	if err := tx.Model(&token).Update("used_at", now).Error; err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (s *AuthService) appLink(path, token string) string {
+	return s.appBaseURL + path + "?token=" + url.QueryEscape(token)
+}
+
+// Send the verification mail of a new user without failing registration
+func (s *AuthService) sendWelcomeVerification(userID uint) {
+	if err := s.SendVerificationEmail(userID); err != nil {
+		log.Printf("Failed to send verification email to user %d: %v", userID, err)
+	}
+}